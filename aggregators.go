@@ -1,25 +1,38 @@
 package main
 
 import (
+	"math"
 	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/ccpgames/aggregateD/input"
 	"github.com/ccpgames/aggregateD/output"
+	"github.com/ccpgames/aggregateD/sketch"
 )
 
-func (m *Main) gaugeAggregator(receivedMetric input.Metric, bucket *output.Bucket) {
-	_, ok := bucket.Fields["value"]
+func (s *shard) gaugeAggregator(key seriesKey, receivedMetric input.Metric, bucket *output.Bucket) {
+	value := receivedMetric.Value
+
+	//a delta is applied to the last known value of the gauge, which is kept
+	//between flushes as the gauge may not have been set since the last one
+	gauge, ok := s.gauges[key]
 
 	if !ok {
-		bucket.Fields["value"] = 0
+		gauge = new(gaugeValue)
+		s.gauges[key] = gauge
 	}
 
-	bucket.Timestamp = parseTimestamp(receivedMetric.Timestamp)
-	bucket.Fields["value"] = receivedMetric.Value
+	if receivedMetric.Delta {
+		value += gauge.value
+	}
+
+	gauge.value = value
+	gauge.idleFlushes = 0
+	bucket.Fields["value"] = value
 }
 
-func (m *Main) counterAggregator(receivedMetric input.Metric, bucket *output.Bucket) {
+func (s *shard) counterAggregator(key seriesKey, receivedMetric input.Metric, bucket *output.Bucket) {
 	_, ok := bucket.Fields["value"]
 
 	if !ok {
@@ -37,41 +50,199 @@ func (m *Main) counterAggregator(receivedMetric input.Metric, bucket *output.Buc
 	sampledValue := receivedMetric.Value * (1 / receivedMetric.Sampling)
 	previousValue := bucket.Fields["value"].(float64)
 	bucket.Fields["value"] = sampledValue + previousValue
-	bucket.Timestamp = parseTimestamp(receivedMetric.Timestamp)
 
 }
 
-func (m *Main) setAggregator(receivedMetric input.Metric, bucket *output.Bucket) {
-	k := strconv.FormatFloat(float64(receivedMetric.Value), 'f', 2, 32)
-	bucket.Fields[k] = receivedMetric.Value
+func (s *shard) setAggregator(key seriesKey, receivedMetric input.Metric, bucket *output.Bucket) {
+	if bucket.Set == nil {
+		bucket.Set = sketch.NewSet(configuration.SetExactThreshold, configuration.SetPrecision)
+	}
+
+	member := receivedMetric.SetMember
+
+	//members sent by older clients only have a numeric value
+	if member == "" {
+		member = strconv.FormatFloat(receivedMetric.Value, 'f', -1, 64)
+	}
+
+	bucket.Set.Add(member)
+}
+
+//setSummariser counts the unique members of a set
+func (s *shard) setSummariser(bucket *output.Bucket) {
+	if bucket.Set == nil {
+		return
+	}
+
+	bucket.Fields["count"] = int64(bucket.Set.Count())
+}
+
+func (s *shard) histogramAggregator(key seriesKey, receivedMetric input.Metric, bucket *output.Bucket) {
+	if bucket.Sketch == nil {
+		bucket.Sketch = newSketch()
+	}
+
+	bucket.Sketch.Add(receivedMetric.Value, 1)
+}
+
+//histogramSummariser calculates the statistics of a histogram from its sketch,
+//quantiles are accurate to within the configured histogram accuracy
+func (s *shard) histogramSummariser(bucket *output.Bucket) {
+	if bucket.Sketch == nil {
+		return
+	}
+
+	bucket.Fields["count"] = bucket.Sketch.Count()
+	bucket.Fields["avg"] = bucket.Sketch.Sum() / bucket.Sketch.Count()
+	bucket.Fields["max"] = bucket.Sketch.Max()
+	bucket.Fields["min"] = bucket.Sketch.Min()
+
+	quantiles, ok := configuration.HistogramPercentileOverrides[bucket.Name]
+
+	if !ok {
+		quantiles = configuration.HistogramPercentiles
+	}
+
+	for _, quantile := range quantiles {
+		field := percentileField(quantile)
+
+		//histograms without configured quantiles keep their original fields
+		if legacyField, isLegacy := legacyPercentileFields[quantile]; isLegacy && !ok && configuration.HistogramLegacyFields {
+			field = legacyField
+		}
+		bucket.Fields[field] = bucket.Sketch.Quantile(quantile)
+	}
+}
+
+//legacyPercentileFields are the fields of the default histogram quantiles
+//before quantiles were configurable
+var legacyPercentileFields = map[float64]string{0.5: "median", 0.95: "95percentile"}
+
+//percentileField names the field of a quantile after its digits, so
+//0.5 is p50, 0.99 is p99 and 0.999 is p999
+func percentileField(quantile float64) string {
+	digits := strings.TrimPrefix(strconv.FormatFloat(quantile, 'f', -1, 64), "0.")
+
+	if len(digits) < 2 {
+		digits += "0"
+	}
+
+	return "p" + digits
+}
+
+//newSketch creates a sketch for a histogram or distribution bucket, these
+//have bounded memory no matter how many values are in the bucket
+func newSketch() *sketch.DDSketch {
+	return sketch.NewDDSketch(configuration.HistogramAccuracy, configuration.HistogramMaxBins)
 }
 
-func (m *Main) histogramAggregator(receivedMetric input.Metric, bucket *output.Bucket) {
-	bucket.Timestamp = parseTimestamp(receivedMetric.Timestamp)
+func (s *shard) timerAggregator(key seriesKey, receivedMetric input.Metric, bucket *output.Bucket) {
+	_, ok := bucket.Fields["count"]
 
+	if !ok {
+		bucket.Fields["count"] = 0.0
+	}
+
+	if receivedMetric.Sampling == 0 {
+		receivedMetric.Sampling = 1
+	}
+
+	//a sampled timing stands in for the timings which were not sent, so it
+	//counts more than once, the timing itself is only kept once
+	previousCount := bucket.Fields["count"].(float64)
+	bucket.Fields["count"] = previousCount + (1 / receivedMetric.Sampling)
 	bucket.Values = append(bucket.Values, receivedMetric.Value)
-	sort.Float64s(bucket.Values)
-	count := float64(len(bucket.Values))
+}
+
+//timerSummariser calculates the statistics for a timer bucket once all of its
+//timings have been received, these match those calculated by etsy's statsD
+func (s *shard) timerSummariser(bucket *output.Bucket) {
+	values := bucket.Values
+	count := len(values)
 
-	total := 0.0
-	for _, x := range bucket.Values {
-		total += x
+	if count == 0 {
+		return
 	}
 
-	//calculate stats from the values
-	//go doesn't seem to have a decent stats library so none is used
-	average := total / count
-	median := bucket.Values[len(bucket.Values)/2]
-	max := bucket.Values[int(count-1)]
-	min := bucket.Values[0]
-	index := float64(0.95) * count
-	percentile95 := bucket.Values[int(index)]
+	sort.Float64s(values)
 
-	bucket.Fields["count"] = count
-	bucket.Fields["avg"] = average
+	//cumulative sums allow the sum of the timings below each percentile
+	//to be found without iterating over the values again
+	cumulativeValues := make([]float64, count)
+	sum := 0.0
+	sumSquares := 0.0
+
+	for i, value := range values {
+		sum += value
+		sumSquares += value * value
+		cumulativeValues[i] = sum
+	}
+
+	mean := sum / float64(count)
+	variance := 0.0
+
+	for _, value := range values {
+		variance += (value - mean) * (value - mean)
+	}
+
+	median := values[count/2]
+	if count%2 == 0 {
+		median = (values[count/2-1] + values[count/2]) / 2
+	}
+
+	bucket.Fields["sum"] = sum
+	bucket.Fields["sum_squares"] = sumSquares
+	bucket.Fields["mean"] = mean
 	bucket.Fields["median"] = median
-	bucket.Fields["max"] = max
-	bucket.Fields["min"] = min
-	bucket.Fields["95percentile"] = percentile95
+	bucket.Fields["min"] = values[0]
+	bucket.Fields["max"] = values[count-1]
+	bucket.Fields["stddev"] = math.Sqrt(variance / float64(count))
+
+	for _, percentile := range configuration.TimerPercentiles {
+		inPercentile := int(math.Floor(percentile/100*float64(count) + 0.5))
 
+		if inPercentile == 0 {
+			continue
+		}
+
+		//percentiles such as 99.9 are written as 99_9
+		suffix := strings.Replace(strconv.FormatFloat(percentile, 'f', -1, 64), ".", "_", -1)
+
+		bucket.Fields["count_"+suffix] = float64(inPercentile)
+		bucket.Fields["upper_"+suffix] = values[inPercentile-1]
+		bucket.Fields["sum_"+suffix] = cumulativeValues[inPercentile-1]
+		bucket.Fields["mean_"+suffix] = cumulativeValues[inPercentile-1] / float64(inPercentile)
+	}
+}
+
+func (s *shard) distributionAggregator(key seriesKey, receivedMetric input.Metric, bucket *output.Bucket) {
+	if bucket.Sketch == nil {
+		bucket.Sketch = newSketch()
+	}
+
+	if receivedMetric.Sampling == 0 {
+		receivedMetric.Sampling = 1
+	}
+
+	//as with timers a sampled value stands in for the values which were not
+	//sent, unlike histograms this is reflected in the count, sum and quantiles
+	bucket.Sketch.Add(receivedMetric.Value, 1/receivedMetric.Sampling)
+}
+
+//distributionSummariser calculates the same statistics as a dogstatsD
+//distribution once all of the values in a bucket have been received
+func (s *shard) distributionSummariser(bucket *output.Bucket) {
+	if bucket.Sketch == nil {
+		return
+	}
+
+	bucket.Fields["count"] = bucket.Sketch.Count()
+	bucket.Fields["sum"] = bucket.Sketch.Sum()
+	bucket.Fields["avg"] = bucket.Sketch.Sum() / bucket.Sketch.Count()
+	bucket.Fields["min"] = bucket.Sketch.Min()
+	bucket.Fields["max"] = bucket.Sketch.Max()
+
+	for _, percentile := range []int{50, 75, 90, 95, 99} {
+		bucket.Fields["p"+strconv.Itoa(percentile)] = bucket.Sketch.Quantile(float64(percentile) / 100)
+	}
 }
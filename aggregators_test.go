@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/ccpgames/aggregateD/input"
+	"github.com/ccpgames/aggregateD/output"
+)
+
+func newTestBucket() *output.Bucket {
+	bucket := new(output.Bucket)
+	bucket.Fields = make(map[string]interface{})
+	bucket.Tags = make(map[string]string)
+	return bucket
+}
+
+func TestTimerAggregator(t *testing.T) {
+	configuration.TimerPercentiles = []float64{90, 99.9}
+	s := newShard()
+	bucket := newTestBucket()
+
+	for i := 1; i <= 10; i++ {
+		s.timerAggregator(seriesKey{}, input.Metric{Type: "timer", Value: float64(i), Sampling: 0.5}, bucket)
+	}
+	s.timerSummariser(bucket)
+
+	expected := map[string]float64{
+		"count":      20,
+		"sum":        55,
+		"mean":       5.5,
+		"median":     5.5,
+		"min":        1,
+		"max":        10,
+		"count_90":   9,
+		"upper_90":   9,
+		"sum_90":     45,
+		"mean_90":    5,
+		"upper_99_9": 10,
+	}
+
+	for field, value := range expected {
+		if bucket.Fields[field] != value {
+			t.Errorf("Expected %s to be %v got %v", field, value, bucket.Fields[field])
+		}
+	}
+
+	stddev := bucket.Fields["stddev"].(float64)
+	if stddev < 2.872 || stddev > 2.873 {
+		t.Error("Expected stddev of 2.872 got", stddev)
+	}
+}
+
+func TestDistributionAggregator(t *testing.T) {
+	configuration.HistogramAccuracy = 0.01
+	configuration.HistogramMaxBins = 2048
+	s := newShard()
+	bucket := newTestBucket()
+
+	for i := 1; i <= 100; i++ {
+		s.distributionAggregator(seriesKey{}, input.Metric{Type: "distribution", Value: float64(i), Sampling: 0.5}, bucket)
+	}
+	s.distributionSummariser(bucket)
+
+	expected := map[string]float64{
+		"count": 200,
+		"sum":   10100,
+		"avg":   50.5,
+		"min":   1,
+		"max":   100,
+		"p50":   50,
+		"p95":   95,
+		"p99":   99,
+	}
+
+	for field, value := range expected {
+		actual := bucket.Fields[field].(float64)
+
+		//quantiles are estimated by the sketch
+		if math.Abs(actual-value) > value*0.01 {
+			t.Errorf("Expected %s to be %v got %v", field, value, actual)
+		}
+	}
+}
+
+func TestHistogramAggregator(t *testing.T) {
+	configuration.HistogramAccuracy = 0.01
+	configuration.HistogramMaxBins = 2048
+	configuration.HistogramPercentiles = []float64{0.5, 0.95}
+	s := newShard()
+	bucket := newTestBucket()
+
+	for i := 1000; i >= 1; i-- {
+		s.histogramAggregator(seriesKey{}, input.Metric{Type: "histogram", Value: float64(i), Sampling: 0.5}, bucket)
+	}
+	s.histogramSummariser(bucket)
+
+	if len(bucket.Values) != 0 {
+		t.Error("Expected histogram values not to be kept, got", len(bucket.Values))
+	}
+
+	expected := map[string]float64{
+		"count": 1000,
+		"avg":   500.5,
+		"min":   1,
+		"max":   1000,
+		"p50":   500,
+		"p95":   950,
+	}
+
+	for field, value := range expected {
+		actual := bucket.Fields[field].(float64)
+
+		if math.Abs(actual-value) > value*0.01 {
+			t.Errorf("Expected %s to be %v got %v", field, value, actual)
+		}
+	}
+}
+
+func TestLegacyHistogramFields(t *testing.T) {
+	configuration.HistogramAccuracy = 0.01
+	configuration.HistogramMaxBins = 2048
+	configuration.HistogramPercentiles = []float64{0.5, 0.95}
+	configuration.HistogramLegacyFields = true
+	defer func() { configuration.HistogramLegacyFields = false }()
+	s := newShard()
+
+	bucket := newTestBucket()
+	s.histogramAggregator(seriesKey{}, input.Metric{Type: "histogram", Value: 1}, bucket)
+	s.histogramSummariser(bucket)
+
+	for _, field := range []string{"median", "95percentile"} {
+		if _, ok := bucket.Fields[field]; !ok {
+			t.Error("Expected field", field, "got", bucket.Fields)
+		}
+	}
+
+	if _, ok := bucket.Fields["p50"]; ok {
+		t.Error("Expected the median not to be written as p50 got", bucket.Fields)
+	}
+}
+
+func TestGaugeDeltas(t *testing.T) {
+	s := newShard()
+	key := seriesKey{Identity: "connections"}
+
+	bucket := newTestBucket()
+	s.gaugeAggregator(key, input.Metric{Type: "gauge", Value: 10}, bucket)
+	s.gaugeAggregator(key, input.Metric{Type: "gauge", Value: 5, Delta: true}, bucket)
+
+	if bucket.Fields["value"] != 15.0 {
+		t.Error("Expected gauge value of 15 got", bucket.Fields["value"])
+	}
+
+	//a new bucket, as after a flush, should start from the last known value
+	bucket = newTestBucket()
+	s.gaugeAggregator(key, input.Metric{Type: "gauge", Value: -3, Delta: true}, bucket)
+
+	if bucket.Fields["value"] != 12.0 {
+		t.Error("Expected gauge value of 12 got", bucket.Fields["value"])
+	}
+
+	s.gaugeAggregator(key, input.Metric{Type: "gauge", Value: 4}, bucket)
+
+	if bucket.Fields["value"] != 4.0 {
+		t.Error("Expected gauge value of 4 got", bucket.Fields["value"])
+	}
+}
+
+func TestGaugeExpiry(t *testing.T) {
+	configuration.GaugeExpiryFlushes = 2
+	defer func() { configuration.GaugeExpiryFlushes = 0 }()
+	s := newShard()
+	key := seriesKey{Identity: "connections"}
+
+	s.gaugeAggregator(key, input.Metric{Type: "gauge", Value: 10}, newTestBucket())
+
+	//the flush which includes the sample and 1 flush without a sample
+	s.flush(0)
+	s.flush(0)
+
+	bucket := newTestBucket()
+	s.gaugeAggregator(key, input.Metric{Type: "gauge", Value: 1, Delta: true}, bucket)
+
+	if bucket.Fields["value"] != 11.0 {
+		t.Error("Expected the gauge to be kept got", bucket.Fields["value"])
+	}
+
+	for i := 0; i < 3; i++ {
+		s.flush(0)
+	}
+
+	if len(s.gauges) != 0 {
+		t.Error("Expected the gauge to be forgotten after 2 flushes without a sample got", s.gauges)
+	}
+
+	bucket = newTestBucket()
+	s.gaugeAggregator(key, input.Metric{Type: "gauge", Value: 1, Delta: true}, bucket)
+
+	if bucket.Fields["value"] != 1.0 {
+		t.Error("Expected a delta to a forgotten gauge to start from 0 got", bucket.Fields["value"])
+	}
+}
+
+func TestHistogramPercentileOverrides(t *testing.T) {
+	configuration.HistogramAccuracy = 0.01
+	configuration.HistogramMaxBins = 2048
+	configuration.HistogramPercentiles = []float64{0.5}
+	configuration.HistogramPercentileOverrides = map[string][]float64{
+		"api.latency": {0.9, 0.99, 0.999},
+	}
+	s := newShard()
+
+	bucket := newTestBucket()
+	bucket.Name = "api.latency"
+	s.histogramAggregator(seriesKey{}, input.Metric{Type: "histogram", Value: 1}, bucket)
+	s.histogramSummariser(bucket)
+
+	for _, field := range []string{"p90", "p99", "p999"} {
+		if _, ok := bucket.Fields[field]; !ok {
+			t.Error("Expected field", field, "got", bucket.Fields)
+		}
+	}
+
+	if _, ok := bucket.Fields["p50"]; ok {
+		t.Error("Expected default percentiles to be overridden got", bucket.Fields)
+	}
+
+	bucket = newTestBucket()
+	bucket.Name = "queue.size"
+	s.histogramAggregator(seriesKey{}, input.Metric{Type: "histogram", Value: 1}, bucket)
+	s.histogramSummariser(bucket)
+
+	if _, ok := bucket.Fields["p50"]; !ok {
+		t.Error("Expected default percentiles got", bucket.Fields)
+	}
+}
+
+func TestPercentileField(t *testing.T) {
+	expected := map[float64]string{
+		0.5:    "p50",
+		0.05:   "p05",
+		0.9:    "p90",
+		0.99:   "p99",
+		0.999:  "p999",
+		0.9999: "p9999",
+	}
+
+	for quantile, field := range expected {
+		if percentileField(quantile) != field {
+			t.Errorf("Expected %v to be named %s got %s", quantile, field, percentileField(quantile))
+		}
+	}
+}
+
+func TestSetAggregator(t *testing.T) {
+	configuration.SetExactThreshold = 1000
+	configuration.SetPrecision = 14
+	s := newShard()
+	bucket := newTestBucket()
+
+	for _, member := range []string{"alice", "bob", "alice", "carol"} {
+		s.setAggregator(seriesKey{}, input.Metric{Type: "set", SetMember: member}, bucket)
+	}
+	s.setAggregator(seriesKey{}, input.Metric{Type: "set", Value: 765}, bucket)
+	s.setAggregator(seriesKey{}, input.Metric{Type: "set", Value: 765}, bucket)
+	s.setSummariser(bucket)
+
+	if bucket.Fields["count"] != int64(4) {
+		t.Error("Expected 4 unique members got", bucket.Fields["count"])
+	}
+
+	if len(bucket.Fields) != 1 {
+		t.Error("Expected only a count field got", bucket.Fields)
+	}
+}
+
+func TestAlignedWindows(t *testing.T) {
+	configuration.AggregationInterval = 10
+	s := newShard()
+
+	for _, timestamp := range []float64{1461204543, 1461204549, 1461204550, 1461204561} {
+		metric := input.Metric{Name: "requests", Type: "counter", Value: 1, Sampling: 1, Timestamp: timestamp}
+		s.aggregateMetric(newSeriesKey(metric, nil), metric)
+	}
+
+	for _, windows := range s.metricBuckets {
+		if len(windows) != 3 {
+			t.Fatal("Expected 3 windows got", len(windows))
+		}
+
+		expected := map[int]float64{1461204540: 2, 1461204550: 1, 1461204560: 1}
+
+		for start, value := range expected {
+			window := windows[start]
+
+			if window.MetricBucket == nil || window.MetricBucket.Timestamp.Unix() != int64(start) {
+				t.Error("Expected a window starting at", start)
+				continue
+			}
+
+			if window.MetricBucket.Fields["value"] != value {
+				t.Error("Expected window value of", value, "got", window.MetricBucket.Fields["value"])
+			}
+		}
+	}
+}
+
+func TestLateMetrics(t *testing.T) {
+	configuration.AggregationInterval = 10
+	configuration.LateSamples = "drop"
+	s := newShard()
+	s.watermark = 1461204550
+
+	s.aggregateMetric(seriesKey{Identity: "requests"}, input.Metric{Name: "requests", Type: "counter", Value: 1, Timestamp: 1461204549})
+	s.aggregateMetric(seriesKey{Identity: "requests"}, input.Metric{Name: "requests", Type: "counter", Value: 1, Timestamp: 1461204550})
+
+	if s.lateSamples != 1 {
+		t.Error("Expected 1 late sample got", s.lateSamples)
+	}
+
+	if len(s.metricBuckets) != 1 || len(s.lateMetrics) != 0 {
+		t.Error("Expected the late sample to be dropped got", s.metricBuckets, s.lateMetrics)
+	}
+
+	configuration.LateSamples = "output"
+	s.aggregateMetric(seriesKey{Identity: "requests"}, input.Metric{Name: "requests", Type: "counter", Value: 1, Timestamp: 1461204540})
+
+	if len(s.lateMetrics) != 1 || s.lateMetrics[0].Tags["late"] != "true" {
+		t.Error("Expected the late sample to be output with a late tag got", s.lateMetrics)
+	}
+}
+
+func TestShardFinalFlush(t *testing.T) {
+	configuration.AggregationInterval = 10
+	s := newShard()
+	go s.run()
+
+	//the open window and the metric still waiting in the shard's channel
+	//are both included in a final flush
+	metric := input.Metric{Name: "requests", Type: "counter", Value: 1, Sampling: 1, Timestamp: 1461204545}
+	key := newSeriesKey(metric, nil)
+	s.metricsIn <- keyedMetric{key: key, metric: metric}
+	s.metricsIn <- keyedMetric{key: key, metric: metric}
+
+	flushed := make(chan shardFlush, 1)
+	s.flushRequests <- flushRequest{cutoff: math.MaxInt32, flushed: flushed}
+	buckets := (<-flushed).buckets
+
+	if len(buckets) != 1 || buckets[0].Fields["value"] != 2.0 {
+		t.Error("Expected a single bucket with a value of 2 got", buckets)
+	}
+}
+
+func TestJSONSetAggregated(t *testing.T) {
+	configuration.AggregationInterval = 10
+	configuration.SetExactThreshold = 1000
+	configuration.SetPrecision = 14
+
+	listener, err := input.New("json", input.ListenerConfig{Address: "127.0.0.1", Port: "18003"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := make(chan input.Metric, 10)
+	if err := listener.Start(context.Background(), input.Sink{Metrics: metrics}); err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Stop()
+
+	//string members are counted by the set aggregator rather than being
+	//written with a value of 0
+	for _, member := range []string{"alice", "bob", "alice"} {
+		body := `{"name": "uniques", "type": "set", "value": "` + member + `", "timestamp": 1461204545}`
+		response, err := http.Post("http://127.0.0.1:18003/metrics", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+	}
+
+	m := new(Main)
+	s := newShard()
+	m.shards = []*shard{s}
+	go s.run()
+
+	for i := 0; i < 3; i++ {
+		m.receiveMetric(<-metrics)
+	}
+
+	flushed := make(chan shardFlush, 1)
+	s.flushRequests <- flushRequest{cutoff: math.MaxInt32, flushed: flushed}
+	buckets := (<-flushed).buckets
+
+	if len(m.unaggregatedMetrics) != 0 {
+		t.Error("Expected no unaggregated metrics got", m.unaggregatedMetrics)
+	}
+
+	if len(buckets) != 1 || buckets[0].Fields["count"] != int64(2) {
+		t.Error("Expected a set with 2 members got", buckets)
+	}
+}
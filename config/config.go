@@ -2,23 +2,89 @@ package config
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
 	"log"
-	"net/url"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 
-	"github.com/ccpgames/aggregateD/health"
 	"github.com/ccpgames/aggregateD/input"
 	"github.com/ccpgames/aggregateD/output"
+	"github.com/spf13/cast"
 	"github.com/spf13/viper"
 )
 
+//inputBinding is where an input listens, used to find inputs which
+//would fail to listen because another input has their port
+type inputBinding struct {
+	listenerType string
+	network      string
+	address      string
+	port         string
+}
+
+//RedisReplay is an InfluxDB output whose Redis fallback is replayed into it.
+//Replays are retried and pass through the circuit breaker of the output, but
+//are neither written to its fallback nor spooled, points which could not be
+//replayed are kept in Redis
+type RedisReplay struct {
+	Output       output.Writer
+	InfluxConfig output.InfluxDBConfig
+	Fallback     *output.RedisWriter
+}
+
 //Configuration encapsulates all config options for aggregated
 type Configuration struct {
-	InfluxConfig        output.InfluxDBConfig
-	JSONOutputURL       url.URL
-	RedisOutputURL      url.URL
-	FlushInterval       int
+	InfluxConfig output.InfluxDBConfig
+	HealthCheck  bool
+	//Inputs are created but not started, so that they can be started once
+	//aggregation is ready to receive from them
+	Inputs []input.Listener
+	//Outputs are written every flush, outputs which are only the fallback of
+	//another output are written through that output
+	Outputs []output.Writer
+	//RedisReplays are the InfluxDB outputs which have a Redis fallback
+	RedisReplays []RedisReplay
+	//Breakers are the circuit breakers of every output which has one
+	Breakers      []*output.CircuitBreaker
+	FlushInterval int
+	//OutputQueueDepth is the number of flushes which may wait to be written,
+	//OutputQueueDropPolicy decides which flush is dropped when it is full
+	OutputQueueDepth      int
+	OutputQueueDropPolicy string
+	OutputWriters         int
+	//ShutdownTimeout is how many seconds the final flush has to be written
+	//when aggregateD is stopped
+	ShutdownTimeout     int
 	AggregationInterval int
+	AggregationShards   int
+	//LatenessTolerance is how many seconds after a window closes metrics
+	//for it are still accepted, LateSamples is drop or output
+	LatenessTolerance int
+	LateSamples       string
+	//GaugeExpiryFlushes is how many flushes without a sample the last value
+	//of a gauge is kept for, zero keeps it for as long as aggregateD runs
+	GaugeExpiryFlushes int
+	//SeriesIdentityFields are the secondary data fields which distinguish
+	//one series from another, other secondary data does not split a series
+	SeriesIdentityFields []string
+	TimerPercentiles     []float64
+	HistogramAccuracy    float64
+	HistogramMaxBins     int
+	//HistogramPercentiles are the quantiles calculated for every histogram,
+	//unless the histogram has its own quantiles in HistogramPercentileOverrides
+	HistogramPercentiles         []float64
+	HistogramPercentileOverrides map[string][]float64
+	//HistogramLegacyFields is set when histogramPercentiles is not, the
+	//default median and 95th percentile are then written as the median and
+	//95percentile fields which histograms had before quantiles were configurable
+	HistogramLegacyFields bool
+	//SetExactThreshold is the number of members a set may have before its
+	//members are estimated by a HyperLogLog of SetPrecision
+	SetExactThreshold int
+	SetPrecision      uint
 }
 
 //ReadConfig takes a file path as a string and returns a string representing
@@ -38,99 +104,617 @@ func ReadConfig(configFile string) ([]byte, error) {
 	return f, err
 }
 
-//ParseConfig reads in a config file entitled in yaml format and starts
-//the appropriate input listeners and returns a
+//ParseConfig reads in a config file entitled in yaml format, creates the
+//input listeners and outputs and returns a
 //Configuration struct representing the parsed configuration
-func ParseConfig(rawConfig []byte, metricsIn chan input.Metric, eventsIn chan input.Event) Configuration {
+func ParseConfig(rawConfig []byte) Configuration {
 	parsedConfig := new(Configuration)
-	outputUndefined := true
-	inputUndefied := true
 
 	viper.SetConfigType("yaml")
 	viper.ReadConfig(bytes.NewBuffer(rawConfig))
 
-	if viper.GetBool("outputInfluxDB") {
-		parsedConfig.InfluxConfig = output.InfluxDBConfig{
-			InfluxURL:       viper.GetString("influx.url"),
-			InfluxUsername:  viper.GetString("influx.username"),
-			InfluxPassword:  viper.GetString("influx.password"),
-			InfluxDefaultDB: viper.GetString("influx.defaultDB"),
+	//default write interval is 60 seconds
+	viper.SetDefault("flushInterval", 60)
+	parsedConfig.FlushInterval = viper.GetInt("flushInterval")
+
+	getOutputs("outputs", parsedConfig)
+
+	//if there is no where defined to submit metrics to, exit
+	if len(parsedConfig.Outputs) == 0 {
+		panic("No outputs defined")
+	}
+
+	//the health check reports on the first InfluxDB output
+	for _, settings := range getOutputSettings("outputs") {
+		if settings.String("type", "") == "influxdb" {
+			parsedConfig.InfluxConfig, _ = output.NewInfluxDBConfig(settings.String("name", "influxdb"), settings)
+			break
+		}
+	}
+
+	//the largest possible UDP payload, this ensures that datagrams from clients
+	//which buffer several metrics into one packet are never truncated
+	viper.SetDefault("UDPBufferSize", 65535)
+
+	parsedConfig.Inputs = getInputs("inputs", viper.GetInt("UDPBufferSize"))
+
+	if len(parsedConfig.Inputs) == 0 {
+		panic("No inputs defined")
+	}
+
+	parsedConfig.HealthCheck = viper.GetBool("healthCheck")
+
+	//flushes are queued for the writers, by default a flush is held for up to
+	//ten minutes of output downtime before the oldest is dropped
+	viper.SetDefault("outputQueueDepth", 10)
+	viper.SetDefault("outputQueueDropPolicy", output.DropOldest)
+	viper.SetDefault("outputWriters", 1)
+	parsedConfig.OutputQueueDepth = viper.GetInt("outputQueueDepth")
+	parsedConfig.OutputQueueDropPolicy = viper.GetString("outputQueueDropPolicy")
+	parsedConfig.OutputWriters = viper.GetInt("outputWriters")
+
+	if parsedConfig.OutputQueueDepth < 1 {
+		panic("output queue depth must be at least 1")
+	}
+
+	switch parsedConfig.OutputQueueDropPolicy {
+	case output.DropOldest, output.DropNewest, output.DropBlock:
+	default:
+		panic("outputQueueDropPolicy must be oldest, newest or block")
+	}
+
+	if parsedConfig.OutputWriters < 1 {
+		panic("output writers must be at least 1")
+	}
+
+	viper.SetDefault("shutdownTimeout", 30)
+	parsedConfig.ShutdownTimeout = viper.GetInt("shutdownTimeout")
+
+	if parsedConfig.ShutdownTimeout < 1 {
+		panic("shutdown timeout must be at least 1 second")
+	}
+
+	viper.SetDefault("aggregationInterval", 10)
+	parsedConfig.AggregationInterval = viper.GetInt("aggregationInterval")
+
+	if parsedConfig.AggregationInterval < 1 {
+		panic("aggregation interval must be at least 1 second")
+	}
+
+	parsedConfig.SeriesIdentityFields = viper.GetStringSlice("seriesIdentityFields")
+
+	//series are spread across shards which aggregate in parallel
+	viper.SetDefault("aggregationShards", runtime.NumCPU())
+	parsedConfig.AggregationShards = viper.GetInt("aggregationShards")
+
+	if parsedConfig.AggregationShards < 1 {
+		panic("aggregation shards must be at least 1")
+	}
+
+	viper.SetDefault("latenessTolerance", 10)
+	viper.SetDefault("lateSamples", "drop")
+	parsedConfig.LatenessTolerance = viper.GetInt("latenessTolerance")
+	parsedConfig.LateSamples = viper.GetString("lateSamples")
+
+	if parsedConfig.LateSamples != "drop" && parsedConfig.LateSamples != "output" {
+		panic("lateSamples must be either drop or output")
+	}
+
+	parsedConfig.GaugeExpiryFlushes = viper.GetInt("gaugeExpiryFlushes")
+
+	if parsedConfig.GaugeExpiryFlushes < 0 {
+		panic("gaugeExpiryFlushes must not be negative")
+	}
+
+	//the same default as etsy's statsD percentThreshold
+	viper.SetDefault("timerPercentiles", []float64{90})
+	parsedConfig.TimerPercentiles = getFloatSlice("timerPercentiles")
+
+	for _, percentile := range parsedConfig.TimerPercentiles {
+		if percentile <= 0 || percentile > 100 {
+			panic("timer percentiles must be between 0 and 100")
+		}
+	}
+
+	//histogram quantiles are within 1% of the true value by default, 2048 bins
+	//is enough to cover values from a nanosecond to several days at that
+	//accuracy before any bins need to be collapsed
+	viper.SetDefault("histogramAccuracy", 0.01)
+	viper.SetDefault("histogramMaxBins", 2048)
+	parsedConfig.HistogramAccuracy = viper.GetFloat64("histogramAccuracy")
+	parsedConfig.HistogramMaxBins = viper.GetInt("histogramMaxBins")
+
+	if parsedConfig.HistogramAccuracy <= 0 || parsedConfig.HistogramAccuracy >= 1 {
+		panic("histogram accuracy must be between 0 and 1")
+	}
+
+	if parsedConfig.HistogramMaxBins < 1 {
+		panic("histogram max bins must be at least 1")
+	}
+
+	parsedConfig.HistogramLegacyFields = !viper.IsSet("histogramPercentiles")
+	viper.SetDefault("histogramPercentiles", []float64{0.5, 0.95})
+	parsedConfig.HistogramPercentiles = getFloatSlice("histogramPercentiles")
+	validateQuantiles("histogramPercentiles", parsedConfig.HistogramPercentiles)
+	parsedConfig.HistogramPercentileOverrides = getPercentileOverrides("histogramPercentileOverrides")
+
+	viper.SetDefault("setExactThreshold", 1000)
+	viper.SetDefault("setPrecision", 14)
+	parsedConfig.SetExactThreshold = viper.GetInt("setExactThreshold")
+	parsedConfig.SetPrecision = uint(viper.GetInt("setPrecision"))
+
+	if parsedConfig.SetPrecision < 4 || parsedConfig.SetPrecision > 18 {
+		panic("set precision must be between 4 and 18")
+	}
+
+	return *parsedConfig
+}
+
+//validateCounterRate ensures an output calculates the rate of counters in
+//a known way, see output.WithCounterRates
+func validateCounterRate(key string, counterRate string) string {
+	switch counterRate {
+	case output.CounterRateWindow, output.CounterRateFlush, output.CounterRateNone:
+		return counterRate
+	default:
+		panic(key + " must be one of window, flush or none")
+	}
+}
+
+//getOutputs creates the outputs listed in the config, i.e.
+//- type: influxdb
+//  url: http://localhost:8086
+//  fallback: redis
+//- type: redis
+//  url: localhost:6379
+//every output has a type and optionally a name, which defaults to its type,
+//a fallback and a counterRate, other settings depend upon the type
+func getOutputs(key string, parsedConfig *Configuration) {
+	list := getOutputSettings(key)
+	writers := make(map[string]output.Writer)
+	unwrapped := make(map[string]output.Writer)
+	fallbackOf := make(map[string]string)
+	isFallback := make(map[string]bool)
+	spoolDirectories := make(map[string]string)
+
+	for _, settings := range list {
+		if fallback := settings.String("fallback", ""); fallback != "" {
+			fallbackOf[settings.String("name", "")] = fallback
+			isFallback[fallback] = true
 		}
-		outputUndefined = false
 	}
 
-	if viper.GetBool("redisOnInfluxFail") {
-		redisURL, err := url.Parse(viper.GetString("redisOutputURL"))
+	for _, settings := range list {
+		name := settings.String("name", "")
+		writer, err := output.New(settings.String("type", ""), name, settings)
 
 		if err != nil {
-			panic("malformed redis URL")
+			panic(err.Error())
+		}
+
+		if _, exists := writers[name]; exists {
+			panic("output " + name + " defined twice")
 		}
 
-		parsedConfig.RedisOutputURL = *redisURL
+		unwrapped[name] = writer
+		counterRate := validateCounterRate("counterRate of output "+name, settings.String("counterRate", output.CounterRateWindow))
+		writers[name] = output.WithCounterRateWriter(writer, counterRate, parsedConfig.FlushInterval)
+
+		//Redis fallbacks keep the type and interval of counters, so that their
+		//rates are added by the output they are replayed into
+		if _, isRedis := writer.(*output.RedisWriter); isRedis && isFallback[name] {
+			writers[name] = writer
+		}
+		writers[name] = withRetries(name, settings, writers[name])
+
+		//a breaker stops a failing output being written, so that its
+		//fallback is written without waiting for the output to fail
+		breakerSettings, err := settings.Section("circuitBreaker")
+
+		if err != nil {
+			panic("output " + name + ": " + err.Error())
+		}
+
+		if breakerSettings != nil {
+			breakerConfig, err := output.NewBreakerConfig(name, breakerSettings)
+
+			if err != nil {
+				panic(err.Error())
+			}
+
+			breaker := output.WithCircuitBreaker(writers[name], breakerConfig)
+			parsedConfig.Breakers = append(parsedConfig.Breakers, breaker)
+			writers[name] = breaker
+		}
+	}
+
+	//fallbacks are resolved once every output exists, so that outputs may be
+	//listed in any order
+	for _, settings := range list {
+		name := settings.String("name", "")
+
+		//outputs which are a fallback are only written when another output fails
+		if isFallback[name] {
+			continue
+		}
+
+		writer := writers[name]
+		seen := map[string]bool{name: true}
+
+		//a chain of fallbacks is followed until an output has no fallback
+		for fallback := fallbackOf[name]; fallback != ""; fallback = fallbackOf[fallback] {
+			if _, exists := writers[fallback]; !exists {
+				panic("fallback " + fallback + " is not defined")
+			}
+
+			if seen[fallback] {
+				panic("fallbacks of output " + name + " form a loop")
+			}
+
+			seen[fallback] = true
+			writer = output.WithFallback(writer, writers[fallback])
+		}
+
+		//batches which neither the output nor its fallbacks could write
+		//are spooled to disk
+		spoolSettings, err := settings.Section("spool")
+
+		if err != nil {
+			panic("output " + name + ": " + err.Error())
+		}
+
+		if spoolSettings != nil {
+			writer = output.WithSpool(writer, openSpool(name, spoolSettings, spoolDirectories))
+		}
+		parsedConfig.Outputs = append(parsedConfig.Outputs, writer)
+	}
+
+	//InfluxDB outputs are replayed from their Redis fallback once they recover
+	for _, settings := range list {
+		name := settings.String("name", "")
+		fallback, isRedis := unwrapped[fallbackOf[name]].(*output.RedisWriter)
+
+		if settings.String("type", "") != "influxdb" || !isRedis {
+			continue
+		}
+
+		influxConfig, _ := output.NewInfluxDBConfig(name, settings)
+		parsedConfig.RedisReplays = append(parsedConfig.RedisReplays, RedisReplay{Output: writers[name], InfluxConfig: influxConfig, Fallback: fallback})
+	}
+}
+
+//withRetries wraps an output so that failed writes are retried, if it has
+//retry settings, i.e.
+//retry:
+//  attempts: 3
+func withRetries(name string, settings output.Settings, writer output.Writer) output.Writer {
+	retrySettings, err := settings.Section("retry")
+
+	if err != nil {
+		panic("output " + name + ": " + err.Error())
+	}
+
+	if retrySettings == nil {
+		return writer
+	}
+
+	retryConfig, err := output.NewRetryConfig(name, retrySettings)
 
+	if err != nil {
+		panic(err.Error())
 	}
-	if (len(parsedConfig.InfluxConfig.InfluxURL)) == 0 {
-		panic("InfluxDB URL undefined")
+
+	return output.WithRetries(writer, retryConfig)
+}
+
+//openSpool opens the spool of an output, spoolDirectories are the directories
+//of the spools already opened so that two outputs cannot share a spool
+func openSpool(name string, settings output.Settings, spoolDirectories map[string]string) *output.Spool {
+	spoolConfig, err := output.NewSpoolConfig(name, settings)
+
+	if err != nil {
+		panic(err.Error())
 	}
 
-	if (len(parsedConfig.InfluxConfig.InfluxUsername)) == 0 {
-		panic("InfluxDB username undefined")
+	directory := filepath.Clean(spoolConfig.Directory)
+	if other, exists := spoolDirectories[directory]; exists {
+		panic("outputs " + other + " and " + name + " both spool to " + directory)
 	}
+	spoolDirectories[directory] = name
 
-	if (len(parsedConfig.InfluxConfig.InfluxPassword)) == 0 {
-		panic("InfluxDB password undefined")
+	spool, err := output.OpenSpool(spoolConfig)
+
+	if err != nil {
+		panic(err.Error())
 	}
 
-	if (len(parsedConfig.InfluxConfig.InfluxDefaultDB)) == 0 {
-		panic("InfluxDB default db undefined")
+	return spool
+}
+
+//getOutputSettings reads the settings of every output, configs without an
+//outputs list have their outputInfluxDB, redisOnInfluxFail and outputJSON
+//settings read as the equivalent list
+func getOutputSettings(key string) []output.Settings {
+	var list []output.Settings
+
+	if viper.Get(key) == nil {
+		return getLegacyOutputSettings()
+	}
+
+	for _, settings := range getSettingsList(key, "outputs") {
+		if _, named := settings["name"]; !named {
+			settings["name"] = settings.String("type", "")
+		}
+		list = append(list, settings)
+	}
+
+	return list
+}
+
+//getLegacyOutputSettings reads outputs configured before outputs were listed
+func getLegacyOutputSettings() []output.Settings {
+	var list []output.Settings
+
+	if viper.GetBool("outputInfluxDB") {
+		influxDB := output.Settings{
+			"type":        "influxdb",
+			"name":        "influxdb",
+			"url":         viper.GetString("influx.url"),
+			"username":    viper.GetString("influx.username"),
+			"password":    viper.GetString("influx.password"),
+			"database":    viper.GetString("influx.defaultDB"),
+			"counterrate": viper.GetString("influx.counterRate"),
+		}
+
+		if viper.GetBool("redisOnInfluxFail") {
+			influxDB["fallback"] = "redis"
+			list = append(list, output.Settings{
+				"type": "redis",
+				"name": "redis",
+				"url":  viper.GetString("redisOutputURL"),
+			})
+		}
+		list = append(list, influxDB)
 	}
 
 	if viper.GetBool("outputJSON") {
-		u, err := url.Parse(viper.GetString("JSONOutputURL"))
+		list = append(list, output.Settings{
+			"type":        "json",
+			"name":        "json",
+			"url":         viper.GetString("JSONOutputURL"),
+			"counterrate": viper.GetString("JSONCounterRate"),
+		})
+	}
+
+	return list
+}
+
+//getFloatSlice reads a list of numbers from the config
+func getFloatSlice(key string) []float64 {
+	return toFloatSlice(key, viper.Get(key))
+}
+
+//toFloatSlice converts a list of numbers read from the config, yaml decodes
+//whole numbers as ints so each element is converted individually
+func toFloatSlice(key string, list interface{}) []float64 {
+	var floats []float64
+
+	switch values := list.(type) {
+	case []float64:
+		floats = values
+	case []interface{}:
+		for _, value := range values {
+			switch number := value.(type) {
+			case int:
+				floats = append(floats, float64(number))
+			case float64:
+				floats = append(floats, number)
+			default:
+				panic(key + " must be a list of numbers")
+			}
+		}
+	default:
+		panic(key + " must be a list of numbers")
+	}
+
+	return floats
+}
+
+//getPercentileOverrides reads a list of metric names and the quantiles
+//which should be calculated for them in place of the defaults, i.e.
+//- metric: api.latency
+//  percentiles: [0.99, 0.999]
+func getPercentileOverrides(key string) map[string][]float64 {
+	overrides := make(map[string][]float64)
+
+	if viper.Get(key) == nil {
+		return overrides
+	}
+
+	list, err := cast.ToSliceE(viper.Get(key))
+
+	if err != nil {
+		panic(key + " must be a list of metrics and percentiles")
+	}
+
+	for _, item := range list {
+		override, err := toSettingsMap(item)
+		metric, metricOK := override["metric"].(string)
+
+		if err != nil || !metricOK {
+			panic(key + " must be a list of metrics and percentiles")
+		}
+
+		overrides[metric] = toFloatSlice(key, override["percentiles"])
+		validateQuantiles(key, overrides[metric])
+	}
+
+	return overrides
+}
+
+//toSettingsMap converts an item of a list in the config to a map. Depending
+//upon the version of viper, YAML maps are decoded with either string or
+//interface{} keys, so both are accepted
+func toSettingsMap(item interface{}) (map[string]interface{}, error) {
+	switch item.(type) {
+	case map[string]interface{}, map[interface{}]interface{}:
+		return cast.ToStringMapE(item)
+	}
+	return nil, fmt.Errorf("%v is not a map", item)
+}
+
+//getSettingsList reads a list of settings such as the inputs or outputs,
+//kind describes what the list is for error messages
+func getSettingsList(key string, kind string) []output.Settings {
+	var list []output.Settings
+	items, err := cast.ToSliceE(viper.Get(key))
+
+	if err != nil {
+		panic(key + " must be a list of " + kind)
+	}
+
+	for _, item := range items {
+		rawSettings, err := toSettingsMap(item)
+
 		if err != nil {
-			log.Fatal(err)
+			panic(key + " must be a list of " + kind)
 		}
-		parsedConfig.JSONOutputURL = *u
-		outputUndefined = false
+
+		//viper does not make keys within lists case insensitive
+		settings := make(output.Settings)
+		for k, v := range rawSettings {
+			settings[strings.ToLower(k)] = v
+		}
+		list = append(list, settings)
 	}
 
-	//if there is no where defined to submit metrics to, exit
-	if outputUndefined {
-		panic("No outputs defined")
+	return list
+}
+
+//getInputs creates the listeners listed in the config, i.e.
+//- type: dogstatsd
+//  address: 127.0.0.1
+//  port: 8125
+//  tags:
+//    tenant: web
+//every input has a type, the other settings are optional
+func getInputs(key string, bufferSize int) []input.Listener {
+	var listeners []input.Listener
+
+	var bound []inputBinding
+
+	for _, settings := range getInputSettings(key) {
+		listenerType := settings.String("type", "")
+		config := input.ListenerConfig{
+			Address:    settings.String("address", ""),
+			Port:       validatePort(listenerType, settings.String("port", input.DefaultPort(listenerType))),
+			BufferSize: bufferSize,
+			Tags:       make(map[string]string),
+		}
+
+		binding := inputBinding{listenerType: listenerType, network: input.Network(listenerType), address: config.Address, port: config.Port}
+		for _, other := range bound {
+			if binding.conflicts(other) {
+				panic(fmt.Sprintf("inputs %s and %s both listen on %s port %s, give each input its own port", other.listenerType, listenerType, binding.network, binding.port))
+			}
+		}
+		bound = append(bound, binding)
+
+		if size := settings.String("bufferSize", ""); size != "" {
+			parsedSize, err := strconv.Atoi(size)
+
+			if err != nil || parsedSize < 1 {
+				panic("bufferSize of input " + listenerType + " must be a positive number")
+			}
+			config.BufferSize = parsedSize
+		}
+
+		if tags, ok := settings["tags"]; ok && tags != nil {
+			tagMap, err := toSettingsMap(tags)
+
+			if err != nil {
+				panic("tags of input " + listenerType + " must be a map of tags and values")
+			}
+
+			for k, v := range tagMap {
+				config.Tags[k] = fmt.Sprint(v)
+			}
+		}
+
+		listener, err := input.New(listenerType, config)
+
+		if err != nil {
+			panic(err.Error())
+		}
+		listeners = append(listeners, listener)
+	}
+
+	return listeners
+}
+
+//getInputSettings reads the settings of every input, configs without an
+//inputs list have their inputJSON, inputDogStatsD and inputStatsD settings
+//read as the equivalent list
+func getInputSettings(key string) []output.Settings {
+	var list []output.Settings
+
+	if viper.Get(key) != nil {
+		return getSettingsList(key, "inputs")
 	}
 
 	if viper.GetBool("inputJSON") {
-		viper.SetDefault("HTTPPort", "8003")
-		go input.ServeHTTP(viper.GetString("HTTPPort"), metricsIn, eventsIn)
-		inputUndefied = false
+		list = append(list, output.Settings{"type": "json", "port": viper.GetString("HTTPPort")})
+	}
+
+	//UDPPort was shared by both UDP inputs, it remains the default for each.
+	//Without it StatsD listens on 8125 as it did before, unless DogStatsD is
+	//also enabled in which case StatsD has its own default port
+	viper.SetDefault("DogStatsDPort", viper.GetString("UDPPort"))
+	viper.SetDefault("StatsDPort", viper.GetString("UDPPort"))
+
+	if viper.GetString("UDPPort") == "" && !viper.GetBool("inputDogStatsD") {
+		viper.SetDefault("StatsDPort", "8125")
 	}
 
 	if viper.GetBool("inputDogStatsD") {
-		viper.SetDefault("UDPPort", "8125")
-		go input.ServeDogStatsD(viper.GetString("UDPPort"), metricsIn, eventsIn)
-		inputUndefied = false
+		list = append(list, output.Settings{"type": "dogstatsd", "port": viper.GetString("DogStatsDPort")})
 	}
 
 	if viper.GetBool("inputStatsD") {
-		viper.SetDefault("UDPPort", "8125")
-		go input.ServeStatD(viper.GetString("UDPPort"), metricsIn)
-		inputUndefied = false
+		list = append(list, output.Settings{"type": "statsd", "port": viper.GetString("StatsDPort")})
 	}
 
-	if inputUndefied {
-		panic("No inputs defined")
-	}
+	return list
+}
 
-	if viper.GetBool("healthCheck") {
-		go health.Serve(parsedConfig.InfluxConfig)
+//validatePort ensures an input listens on a valid port, the port is returned
+//without leading zeros so that ports can be compared
+func validatePort(listenerType string, port string) string {
+	parsedPort, err := strconv.Atoi(port)
+
+	if err != nil || parsedPort < 1 || parsedPort > 65535 {
+		panic("port of input " + listenerType + " must be between 1 and 65535")
 	}
 
-	//default write interval is 60 seconds
-	viper.SetDefault("flushInterval", 60)
-	parsedConfig.FlushInterval = viper.GetInt("flushInterval")
+	return strconv.Itoa(parsedPort)
+}
 
-	viper.SetDefault("aggregationInterval", 10)
-	parsedConfig.AggregationInterval = viper.GetInt("aggregationInterval")
+//conflicts reports whether two inputs would listen on the same port, an
+//empty address listens on every address so it conflicts with any address
+func (binding inputBinding) conflicts(other inputBinding) bool {
+	if binding.network != other.network || binding.port != other.port {
+		return false
+	}
 
-	return *parsedConfig
+	return binding.address == "" || other.address == "" || binding.address == other.address
+}
+
+//validateQuantiles ensures each quantile is strictly between 0 and 1, the
+//minimum and maximum are always calculated
+func validateQuantiles(key string, quantiles []float64) {
+	for _, quantile := range quantiles {
+		if quantile <= 0 || quantile >= 1 {
+			panic(key + " must be between 0 and 1")
+		}
+	}
 }
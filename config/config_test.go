@@ -0,0 +1,211 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+//readmeConfig returns the example config from the README. The example spools
+//to /var/spool and reads certificates which do not exist, so the spool is
+//moved to dir and the tls settings are removed
+func readmeConfig(t *testing.T, dir string) []byte {
+	readme, err := ioutil.ReadFile("../README.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	example := regexp.MustCompile("(?s)```yaml\n(.*?)```").FindSubmatch(readme)
+	if example == nil {
+		t.Fatal("README has no example config")
+	}
+
+	config := regexp.MustCompile(`(?m)^ {6}tls:\n(?: {10}.*\n)+`).ReplaceAllString(string(example[1]), "")
+	config = strings.Replace(config, "/var/spool/aggregated/influxdb", dir, -1)
+	return []byte(config)
+}
+
+func TestReadmeConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	viper.Reset()
+	parsedConfig := ParseConfig(readmeConfig(t, dir))
+
+	if len(parsedConfig.Inputs) != 3 {
+		t.Error("Expected 3 inputs got", len(parsedConfig.Inputs))
+	}
+
+	//the redis output is only a fallback, so it is not written on its own
+	if len(parsedConfig.Outputs) != 2 || parsedConfig.Outputs[1].Name() != "debug" {
+		t.Error("Expected the influxdb and debug outputs got", parsedConfig.Outputs)
+	}
+
+	if len(parsedConfig.RedisReplays) != 1 || len(parsedConfig.Breakers) != 1 {
+		t.Fatal("Expected a redis replay and a circuit breaker got", parsedConfig.RedisReplays, parsedConfig.Breakers)
+	}
+
+	//replays are written through the retries and circuit breaker of the output
+	if parsedConfig.RedisReplays[0].Output != parsedConfig.Breakers[0] {
+		t.Error("Expected the redis replay to be written through the circuit breaker")
+	}
+
+	if parsedConfig.InfluxConfig.InfluxDefaultDB != "myDB" {
+		t.Error("Expected the health check to use the influxdb output got", parsedConfig.InfluxConfig)
+	}
+
+	if len(parsedConfig.HistogramPercentileOverrides["api.request.latency"]) != 3 {
+		t.Error("Expected percentile overrides got", parsedConfig.HistogramPercentileOverrides)
+	}
+
+	if parsedConfig.HistogramLegacyFields {
+		t.Error("Expected configured histogram percentiles to be written as p50 etc.")
+	}
+
+	for _, writer := range parsedConfig.Outputs {
+		writer.Close()
+	}
+
+	//histograms keep their original fields unless percentiles are configured
+	viper.Reset()
+	config := strings.Replace(string(readmeConfig(t, dir)), "histogramPercentiles:", "unusedPercentiles:", 1)
+	parsedConfig = ParseConfig([]byte(config))
+
+	if !parsedConfig.HistogramLegacyFields {
+		t.Error("Expected histograms without configured percentiles to keep the median and 95percentile fields")
+	}
+
+	for _, writer := range parsedConfig.Outputs {
+		writer.Close()
+	}
+}
+
+//TestInterfaceKeyedMaps checks the maps decoded by versions of viper which
+//use yaml.v2, whose keys are interface{} rather than string
+func TestInterfaceKeyedMaps(t *testing.T) {
+	viper.Reset()
+	viper.Set("outputs", []interface{}{
+		map[interface{}]interface{}{
+			"type":  "json",
+			"url":   "http://localhost:9000/metrics",
+			"retry": map[interface{}]interface{}{"attempts": 2},
+		},
+	})
+	viper.Set("inputs", []interface{}{
+		map[interface{}]interface{}{
+			"type": "dogstatsd",
+			"tags": map[interface{}]interface{}{"tenant": "web"},
+		},
+	})
+	viper.Set("overrides", []interface{}{
+		map[interface{}]interface{}{"metric": "api.latency", "percentiles": []interface{}{0.5, 0.99}},
+	})
+
+	outputs := getSettingsList("outputs", "outputs")
+	if len(outputs) != 1 || outputs[0].String("type", "") != "json" {
+		t.Fatal("Expected a json output got", outputs)
+	}
+
+	retry, err := outputs[0].Section("retry")
+	if err != nil || retry.String("attempts", "") != "2" {
+		t.Error("Expected retry settings got", retry, err)
+	}
+
+	if len(getInputs("inputs", 65535)) != 1 {
+		t.Error("Expected a dogstatsd input")
+	}
+
+	if len(getPercentileOverrides("overrides")["api.latency"]) != 2 {
+		t.Error("Expected percentile overrides got", getPercentileOverrides("overrides"))
+	}
+}
+
+//expectPanic reports whether parsing with f panicked, config errors are panics
+func expectPanic(f func()) (panicked bool) {
+	defer func() {
+		panicked = recover() != nil
+	}()
+
+	f()
+	return false
+}
+
+func TestValidatePort(t *testing.T) {
+	for _, port := range []string{"0", "65536", "70000", "-1", "port"} {
+		if !expectPanic(func() { validatePort("statsd", port) }) {
+			t.Error("Expected port", port, "to be rejected")
+		}
+	}
+
+	//leading zeros are removed so that the port can be compared with others
+	if port := validatePort("statsd", "08125"); port != "8125" {
+		t.Error("Expected port 08125 to be read as 8125 got", port)
+	}
+}
+
+func TestInputConflicts(t *testing.T) {
+	inputs := func(items ...map[string]interface{}) func() {
+		return func() {
+			var list []interface{}
+			for _, item := range items {
+				list = append(list, item)
+			}
+
+			viper.Reset()
+			viper.Set("inputs", list)
+			getInputs("inputs", 65535)
+		}
+	}
+
+	//UDP and TCP ports are separate, so a UDP and a TCP input may share a port
+	if expectPanic(inputs(map[string]interface{}{"type": "dogstatsd"}, map[string]interface{}{"type": "json", "port": 8125})) {
+		t.Error("Expected a UDP and a TCP input to share a port")
+	}
+
+	if !expectPanic(inputs(map[string]interface{}{"type": "dogstatsd"}, map[string]interface{}{"type": "statsd", "port": "08125"})) {
+		t.Error("Expected inputs on 8125 and 08125 to conflict")
+	}
+
+	//an input without an address listens on every address
+	if !expectPanic(inputs(map[string]interface{}{"type": "dogstatsd"}, map[string]interface{}{"type": "statsd", "address": "127.0.0.1", "port": 8125})) {
+		t.Error("Expected an input on every address to conflict with an input on 127.0.0.1")
+	}
+
+	if expectPanic(inputs(map[string]interface{}{"type": "dogstatsd", "address": "127.0.0.1"}, map[string]interface{}{"type": "statsd", "address": "127.0.0.2", "port": 8125})) {
+		t.Error("Expected inputs on different addresses to share a port")
+	}
+
+	//StatsD and DogStatsD have their own default ports
+	if expectPanic(inputs(map[string]interface{}{"type": "dogstatsd"}, map[string]interface{}{"type": "statsd"})) {
+		t.Error("Expected StatsD and DogStatsD on their default ports not to conflict")
+	}
+
+	//legacy configs which enable both UDP inputs only conflict if UDPPort
+	//gives both the same port
+	viper.Reset()
+	viper.Set("inputStatsD", true)
+	viper.Set("inputDogStatsD", true)
+
+	if expectPanic(func() { getInputs("inputs", 65535) }) {
+		t.Error("Expected legacy StatsD and DogStatsD inputs on their default ports not to conflict")
+	}
+
+	viper.Set("UDPPort", 8125)
+
+	if !expectPanic(func() { getInputs("inputs", 65535) }) {
+		t.Error("Expected legacy StatsD and DogStatsD inputs sharing UDPPort to conflict")
+	}
+
+	viper.Set("StatsDPort", 8126)
+
+	if expectPanic(func() { getInputs("inputs", 65535) }) {
+		t.Error("Expected legacy inputs with their own ports not to conflict")
+	}
+}
@@ -1,32 +1,67 @@
 package health
 
 import (
+	"fmt"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/ccpgames/aggregateD/output"
 )
 
 type healthHTTPHandler struct {
 	influxdbConfig output.InfluxDBConfig
+	breakers       []*output.CircuitBreaker
 }
 
+//probeTimeout is the longest a ping of InfluxDB may take, a probe should
+//fail rather than wait on an InfluxDB which is not responding
+const probeTimeout = 5 * time.Second
+
 func (handler *healthHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	_, err := http.Get(handler.influxdbConfig.InfluxURL + "/ping")
-	if err != nil {
+	if !InfluxDBHealthy(handler.influxdbConfig) {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("Unable to write to InfluxDB"))
+		handler.writeBreakers(w)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("aggregateD is healthy"))
+	handler.writeBreakers(w)
+}
+
+//writeBreakers lists the state of the circuit breaker of each output,
+//one per line after the status
+func (handler *healthHTTPHandler) writeBreakers(w http.ResponseWriter) {
+	for _, breaker := range handler.breakers {
+		fmt.Fprintf(w, "\n%s circuit breaker is %s", breaker.Name(), breaker.State())
+	}
+}
+
+//InfluxDBHealthy pings InfluxDB and reports whether it responded
+func InfluxDBHealthy(influxdbConfig output.InfluxDBConfig) bool {
+	//the probe uses the TLS settings of the output, its connection is
+	//closed once InfluxDB has responded
+	probeClient := output.NewInfluxDBClient(influxdbConfig)
+	probeClient.Timeout = probeTimeout
+	defer probeClient.CloseIdleConnections()
+
+	response, err := probeClient.Get(influxdbConfig.InfluxURL + "/ping")
+	if err != nil {
+		return false
+	}
+	response.Body.Close()
+
+	return response.StatusCode < http.StatusInternalServerError
 }
 
-//Serve exposes /health
-func Serve(influxdbConfig output.InfluxDBConfig) {
+//Serve exposes /health, which reports whether InfluxDB is reachable and the
+//state of the circuit breakers of the outputs
+func Serve(influxdbConfig output.InfluxDBConfig, breakers []*output.CircuitBreaker) {
 	server := http.NewServeMux()
 	handler := new(healthHTTPHandler)
 	handler.influxdbConfig = influxdbConfig
+	handler.breakers = breakers
 	server.Handle("/health", handler)
 	log.Printf("Serving Healthcheck on port 8000")
 	log.Fatal(http.ListenAndServe(":8000", server))
@@ -1,108 +1,314 @@
 package input
 
 import (
+	"context"
 	"errors"
-	"net"
+	"fmt"
+	"log"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
+var (
+	//dogStatsDMetricTypes maps the dogstatsD metric types to the names of the
+	//aggregators, the full names are also accepted from lenient clients
+	dogStatsDMetricTypes = map[string]string{
+		"c":            "counter",
+		"g":            "gauge",
+		"ms":           "timer",
+		"h":            "histogram",
+		"s":            "set",
+		"d":            "distribution",
+		"counter":      "counter",
+		"gauge":        "gauge",
+		"timer":        "timer",
+		"histogram":    "histogram",
+		"set":          "set",
+		"distribution": "distribution",
+	}
+
+	//dogStatsDParseErrors counts messages which could not be parsed, it is
+	//updated atomically as it is read outside of the listener
+	dogStatsDParseErrors uint64
+)
+
+func init() {
+	//dogstatsD clients buffer multiple metrics, events and service checks
+	//into a single newline delimited datagram, these are split in the
+	//same way as plain statsD messages and handled one by one
+	Register("dogstatsd", "udp", "8125", func(config ListenerConfig) (Listener, error) {
+		return newUDPListener(config, parseDogStatsDMessage), nil
+	})
+}
+
 //ServeDogStatsD serves the dogstatsD protocol over UDP
 //This allows clients which are already instrumented with dogstatsD clients
 //to use aggregateD and the CCP metrics stack without any mododification beyond
-//providing an alternative IP address.
-func ServeDogStatsD(port string, metricsIn chan Metric, eventsIn chan Event) string {
-	var buf [1024]byte
-	addr, err := net.ResolveUDPAddr("udp", ":"+port)
+//providing an alternative IP address. bufferSize is the largest datagram which
+//can be read, anything beyond it is truncated by the socket.
+func ServeDogStatsD(port string, bufferSize int, metricsIn chan Metric, eventsIn chan Event, serviceChecksIn chan ServiceCheck) string {
+	listener, _ := New("dogstatsd", ListenerConfig{Port: port, BufferSize: bufferSize})
+	err := listener.Start(context.Background(), Sink{Metrics: metricsIn, Events: eventsIn, ServiceChecks: serviceChecksIn})
 
 	if err != nil {
 		panic(err)
 	}
 
-	sock, err := net.ListenUDP("udp", addr)
+	select {}
+}
 
-	if err != nil {
-		panic(err)
-	}
+//parseDogStatsDMessage works out whether a single line is an event, a service
+//check or a metric and submits it to the appropriate channel
+func parseDogStatsDMessage(message string, tags map[string]string, sink Sink) {
+	if strings.HasPrefix(message, "_e{") {
+		event, err := parseDogStatsDEvent(message)
 
-	for {
-		rlen, _, _ := sock.ReadFromUDP(buf[:])
-		message := string(buf[:rlen])
+		if err != nil {
+			dogStatsDParseError(err)
+		} else {
+			event.Tags = withDefaultTags(event.Tags, tags)
+			sink.Events <- event
+		}
+	} else if strings.HasPrefix(message, "_sc|") {
+		serviceCheck, err := parseDogStatsDServiceCheck(message)
+
+		if err != nil {
+			dogStatsDParseError(err)
+		} else {
+			serviceCheck.Tags = withDefaultTags(serviceCheck.Tags, tags)
+			sink.ServiceChecks <- serviceCheck
+		}
+	} else {
+		metric, err := parseDogStatsDMetric(message)
 
-		if strings.Index(message, "_e") == -1 {
-			metric, _ := parseDogStatsDMetric(message)
-			metricsIn <- metric
+		if err != nil {
+			dogStatsDParseError(err)
 		} else {
-			//parseDogStatDEvent(message)
+			metric.Tags = withDefaultTags(metric.Tags, tags)
+			sink.Metrics <- metric
 		}
 	}
+}
 
+//dogStatsDParseError records a message which could not be parsed, the message
+//itself is dropped rather than being submitted with zero values
+func dogStatsDParseError(err error) {
+	atomic.AddUint64(&dogStatsDParseErrors, 1)
+	log.Println(err)
 }
+
+//DogStatsDParseErrors returns the number of DogStatsD messages which have
+//been dropped because they could not be parsed
+func DogStatsDParseErrors() uint64 {
+	return atomic.LoadUint64(&dogStatsDParseErrors)
+}
+
 func parseDogStatsDMetric(message string) (Metric, error) {
 	//function to parse a metric struct from a dogstatsd message which takes the
 	//form of:
-	//metric.name:value|type|@sample_rate|#tag1:value,tag2
+	//metric.name:value|type|@sample_rate|#tag1:value,tag2|c:container_id|T1461204545
+	//only the name, value and type are required, the remaining sections are
+	//optional and may appear in any order
+	fields := strings.Split(message, "|")
+	colonIndex := strings.Index(fields[0], ":")
 
-	//the indicies of the various delimiters
-	colonIndex := strings.Index(message, ":")
-	ibarIndex := strings.Index(message, "|")
-	atIndex := strings.Index(message, "@")
-	hashIndex := strings.Index(message, "#")
-	tagMap := make(map[string]string)
-
-	if colonIndex == -1 || ibarIndex == -1 || atIndex == -1 {
+	if len(fields) < 2 || colonIndex < 1 {
 		return Metric{}, errors.New("unable to parse DogStatsD message")
 	}
 
-	//if there is no hash, there are no tags. therefore set hashIndex as the
-	//end of the message and set finished to true so tag parsing never occurs
-	if hashIndex == -1 {
-		hashIndex = len(message)
-	} else {
-		tags := message[hashIndex+1 : len(message)]
-		tagMap = parseTags(tags)
-	}
-
-	name := message[0:colonIndex]
-	value := message[colonIndex+1 : ibarIndex]
-	floatValue, _ := strconv.ParseFloat(value, 64)
-	metricType := message[ibarIndex+1 : atIndex-1]
-	sampleRate := message[atIndex+1 : hashIndex-1]
+	metricType, ok := dogStatsDMetricTypes[fields[1]]
 
-	if sampleRate == "" {
-		return Metric{}, errors.New("unable to parse DogStatsD message")
+	if !ok {
+		return Metric{}, fmt.Errorf("invalid DogStatsD metric type: %q", fields[1])
 	}
 
-	floatSampleRate, err := strconv.ParseFloat(sampleRate, 64)
+	value := fields[0][colonIndex+1:]
+	floatValue, err := strconv.ParseFloat(value, 64)
 
-	if err != nil {
+	//set members are counted as strings, so they need not be numbers
+	if err != nil && metricType != "set" {
 		return Metric{}, errors.New("unable to parse DogStatsD value")
 	}
 
 	parsedMetric := Metric{
-		Name:      name,
-		Timestamp: float64(time.Now().Unix()),
+		Name:      fields[0][:colonIndex],
 		Type:      metricType,
 		Value:     floatValue,
-		Sampling:  floatSampleRate,
-		Tags:      tagMap,
+		Sampling:  1,
+		Tags:      make(map[string]string),
+		Aggregate: true,
+		Delta:     metricType == "gauge" && isGaugeDelta(value),
+	}
+
+	if metricType == "set" {
+		parsedMetric.SetMember = value
+	}
+
+	container := ""
+
+	for _, field := range fields[2:] {
+		switch {
+		case strings.HasPrefix(field, "@"):
+			floatSampleRate, err := strconv.ParseFloat(field[1:], 64)
+
+			if err != nil || floatSampleRate <= 0 || floatSampleRate > 1 {
+				return Metric{}, errors.New("unable to parse DogStatsD sample rate")
+			}
+
+			parsedMetric.Sampling = floatSampleRate
+		case strings.HasPrefix(field, "#"):
+			parsedMetric.Tags = parseTags(field[1:])
+		case strings.HasPrefix(field, "c:"):
+			container = field[2:]
+		case strings.HasPrefix(field, "T"):
+			timestamp, err := strconv.ParseFloat(field[1:], 64)
+
+			if err != nil {
+				return Metric{}, errors.New("unable to parse DogStatsD timestamp")
+			}
+
+			parsedMetric.Timestamp = timestamp
+		}
+	}
+
+	//the container may precede the tags, so it is only added once the
+	//tag map is complete
+	if container != "" {
+		parsedMetric.Tags["container"] = container
+	}
+
+	if parsedMetric.Timestamp == 0 {
+		parsedMetric.Timestamp = float64(time.Now().Unix())
 	}
 
 	return parsedMetric, nil
 }
 
-// func parseDogStatsDEvent(message string) {
-// 	//_e{title.length,text.length}:title|text|d:date_happened|h:hostname|p:priority|t:alert_type|#tag1,tag2
-//
-// 	//a := message[strings.Index(message, "p:")+2 : len(message)]
-//
-// 	titleLengthString := message[strings.Index(message, "{")+1 : strings.Index(message, ",")]
-// 	titleLength, _ := strconv.ParseInt(titleLengthString, 0, 64)
-//
-// 	title := message[strings.Index(message, ":") : strings.Index(message, ":")+titleLength]
-// 	panic(titleLength)
-// }
+//parseDogStatsDEvent parses an event struct from a dogstatsd event message
+//which takes the form of:
+//_e{title.length,text.length}:title|text|d:date_happened|h:hostname|k:aggregation_key|p:priority|s:source_type_name|t:alert_type|#tag1:value,tag2
+//everything after the text is optional and may appear in any order
+func parseDogStatsDEvent(message string) (Event, error) {
+	commaIndex := strings.Index(message, ",")
+	braceIndex := strings.Index(message, "}")
+
+	if !strings.HasPrefix(message, "_e{") || commaIndex == -1 || braceIndex == -1 || commaIndex > braceIndex {
+		return Event{}, errors.New("unable to parse DogStatsD event header")
+	}
+
+	titleLength, titleErr := strconv.Atoi(message[3:commaIndex])
+	textLength, textErr := strconv.Atoi(message[commaIndex+1 : braceIndex])
+
+	if titleErr != nil || textErr != nil || titleLength < 0 || textLength < 0 {
+		return Event{}, errors.New("unable to parse DogStatsD event lengths")
+	}
+
+	//the title and text lengths are given in bytes, so they can be used to
+	//slice the message directly, this allows both to contain pipes
+	body := message[braceIndex+1:]
+	textStart := titleLength + 2
+	textEnd := textStart + textLength
+
+	if len(body) < textEnd || body[0] != ':' || body[titleLength+1] != '|' {
+		return Event{}, errors.New("DogStatsD event is shorter than its declared lengths")
+	}
+
+	//the datadog defaults for events which do not specify a priority or alert type
+	parsedEvent := Event{
+		Name:      body[1 : titleLength+1],
+		Text:      strings.Replace(body[textStart:textEnd], "\\n", "\n", -1),
+		Priority:  "normal",
+		AlertType: "info",
+		Tags:      make(map[string]string),
+	}
+
+	metadata := body[textEnd:]
+
+	if len(metadata) == 0 {
+		return parsedEvent, nil
+	}
+
+	if metadata[0] != '|' {
+		return Event{}, errors.New("unable to parse DogStatsD event metadata")
+	}
+
+	for _, field := range strings.Split(metadata[1:], "|") {
+		switch {
+		case strings.HasPrefix(field, "d:"):
+			timestamp, err := strconv.ParseFloat(field[2:], 64)
+
+			if err != nil {
+				return Event{}, errors.New("unable to parse DogStatsD event timestamp")
+			}
+
+			parsedEvent.Timestamp = timestamp
+		case strings.HasPrefix(field, "h:"):
+			parsedEvent.Host = field[2:]
+		case strings.HasPrefix(field, "k:"):
+			parsedEvent.AggregationKey = field[2:]
+		case strings.HasPrefix(field, "p:"):
+			parsedEvent.Priority = field[2:]
+		case strings.HasPrefix(field, "s:"):
+			parsedEvent.SourceType = field[2:]
+		case strings.HasPrefix(field, "t:"):
+			parsedEvent.AlertType = field[2:]
+		case strings.HasPrefix(field, "#"):
+			parsedEvent.Tags = parseTags(field[1:])
+		}
+	}
+
+	return parsedEvent, nil
+}
+
+//parseDogStatsDServiceCheck parses a service check struct from a dogstatsd
+//service check message which takes the form of:
+//_sc|name|status|d:timestamp|h:hostname|#tag1:value1,tag2|m:service_check_message
+//the message must be the last field as it is allowed to contain pipes
+func parseDogStatsDServiceCheck(message string) (ServiceCheck, error) {
+	fields := strings.Split(message, "|")
+
+	if len(fields) < 3 || fields[0] != "_sc" || fields[1] == "" {
+		return ServiceCheck{}, errors.New("unable to parse DogStatsD service check")
+	}
+
+	status, err := strconv.Atoi(fields[2])
+
+	if err != nil || status < 0 || status > 3 {
+		return ServiceCheck{}, errors.New("unable to parse DogStatsD service check status")
+	}
+
+	parsedServiceCheck := ServiceCheck{
+		Name:   fields[1],
+		Status: status,
+		Tags:   make(map[string]string),
+	}
+
+	for i := 3; i < len(fields); i++ {
+		field := fields[i]
+
+		switch {
+		case strings.HasPrefix(field, "d:"):
+			timestamp, err := strconv.ParseFloat(field[2:], 64)
+
+			if err != nil {
+				return ServiceCheck{}, errors.New("unable to parse DogStatsD service check timestamp")
+			}
+
+			parsedServiceCheck.Timestamp = timestamp
+		case strings.HasPrefix(field, "h:"):
+			parsedServiceCheck.Host = field[2:]
+		case strings.HasPrefix(field, "#"):
+			parsedServiceCheck.Tags = parseTags(field[1:])
+		case strings.HasPrefix(field, "m:"):
+			parsedServiceCheck.Message = strings.Join(fields[i:], "|")[2:]
+			return parsedServiceCheck, nil
+		}
+	}
+
+	return parsedServiceCheck, nil
+}
 
 func parseTags(tags string) map[string]string {
 	tagMap := make(map[string]string)
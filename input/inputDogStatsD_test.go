@@ -53,8 +53,218 @@ func TestMetricParse(t *testing.T) {
 	}
 }
 
-// func TestEventParse(t *testing.T) {
-// 	message := "_e{title.length,text.length}:title|text|d:date_happened|h:hostname|p:priority|t:alert_type|#tag1,tag2"
-// 	parseDogStatsDEvent(message)
-//
-// }
+func TestMetricParseOptionalSections(t *testing.T) {
+	result, err := parseDogStatsDMetric("page.views:1|c|#env:prod")
+
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	if result.Type != "counter" {
+		t.Error("Expected type counter got", result.Type)
+	}
+
+	if result.Sampling != 1 {
+		t.Error("Expected default sampling of 1 got", result.Sampling)
+	}
+
+	if result.Tags["env"] != "prod" {
+		t.Error("Expected tag env:prod got", result.Tags)
+	}
+
+	if !result.Aggregate {
+		t.Error("Expected DogStatsD metrics to be aggregated")
+	}
+
+	result, err = parseDogStatsDMetric("request.time:320|ms|T1461204545|c:abc123|#env:prod|@0.25")
+
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	if result.Type != "timer" {
+		t.Error("Expected type timer got", result.Type)
+	}
+
+	if result.Timestamp != 1461204545 {
+		t.Error("Expected timestamp 1461204545 got", result.Timestamp)
+	}
+
+	if result.Sampling != 0.25 {
+		t.Error("Expected sampling of 0.25 got", result.Sampling)
+	}
+
+	if result.Tags["container"] != "abc123" || result.Tags["env"] != "prod" {
+		t.Error("Expected tags container:abc123 and env:prod got", result.Tags)
+	}
+}
+
+func TestParseErrorsAreCounted(t *testing.T) {
+	metrics := make(chan Metric, 10)
+	before := DogStatsDParseErrors()
+
+	for _, message := range []string{"foo:bar|c", "foo:1|c|@2", "foo:1|x", ":1|c"} {
+		parseDogStatsDMessage(message, nil, Sink{Metrics: metrics})
+	}
+
+	if len(metrics) != 0 {
+		t.Error("Expected invalid metrics to be dropped, got", len(metrics))
+	}
+
+	if DogStatsDParseErrors()-before != 4 {
+		t.Error("Expected 4 parse errors got", DogStatsDParseErrors()-before)
+	}
+}
+
+func TestEventParse(t *testing.T) {
+	message := "_e{7,20}:deploy!|version 1.2|released|d:1461204545|h:web1|k:deploys|p:low|s:jenkins|t:success|#env:prod,canary"
+	result, err := parseDogStatsDEvent(message)
+
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	if result.Name != "deploy!" {
+		t.Error("Expected name deploy! got", result.Name)
+	}
+
+	if result.Text != "version 1.2|released" {
+		t.Error("Expected text version 1.2|released got", result.Text)
+	}
+
+	if result.Timestamp != 1461204545 {
+		t.Error("Expected timestamp 1461204545 got", result.Timestamp)
+	}
+
+	if result.Host != "web1" {
+		t.Error("Expected host web1 got", result.Host)
+	}
+
+	if result.AggregationKey != "deploys" {
+		t.Error("Expected aggregation key deploys got", result.AggregationKey)
+	}
+
+	if result.Priority != "low" {
+		t.Error("Expected priority low got", result.Priority)
+	}
+
+	if result.SourceType != "jenkins" {
+		t.Error("Expected source type jenkins got", result.SourceType)
+	}
+
+	if result.AlertType != "success" {
+		t.Error("Expected alert type success got", result.AlertType)
+	}
+
+	if result.Tags["env"] != "prod" || result.Tags["canary"] != "canary" {
+		t.Error("Expected tags env:prod and canary got", result.Tags)
+	}
+}
+
+func TestEventParseDefaults(t *testing.T) {
+	message := "_e{5,11}:title|line\\nbreak"
+	result, err := parseDogStatsDEvent(message)
+
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	if result.Text != "line\nbreak" {
+		t.Errorf("Expected escaped newline to be unescaped got %q", result.Text)
+	}
+
+	if result.Priority != "normal" || result.AlertType != "info" {
+		t.Error("Expected default priority and alert type got", result.Priority, result.AlertType)
+	}
+}
+
+func TestInvalidEvent(t *testing.T) {
+	messages := []string{
+		"_e{5,6}:title|text",
+		"_e{a,4}:title|text",
+		"_e{5,4}title|text",
+		"_e{5,4:title|text",
+	}
+
+	for _, message := range messages {
+		result, err := parseDogStatsDEvent(message)
+
+		if err == nil {
+			t.Error("expected error, got", result)
+		}
+	}
+}
+
+func TestServiceCheckParse(t *testing.T) {
+	message := "_sc|db.replication|2|d:1461204545|h:db2|#env:prod,primary|m:lag is 30s | paging"
+	result, err := parseDogStatsDServiceCheck(message)
+
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	if result.Name != "db.replication" {
+		t.Error("Expected name db.replication got", result.Name)
+	}
+
+	if result.Status != 2 {
+		t.Error("Expected status 2 got", result.Status)
+	}
+
+	if result.Timestamp != 1461204545 {
+		t.Error("Expected timestamp 1461204545 got", result.Timestamp)
+	}
+
+	if result.Host != "db2" {
+		t.Error("Expected host db2 got", result.Host)
+	}
+
+	if result.Message != "lag is 30s | paging" {
+		t.Error("Expected message lag is 30s | paging got", result.Message)
+	}
+
+	if result.Tags["env"] != "prod" || result.Tags["primary"] != "primary" {
+		t.Error("Expected tags env:prod and primary got", result.Tags)
+	}
+}
+
+func TestInvalidServiceCheck(t *testing.T) {
+	messages := []string{
+		"_sc|db.replication",
+		"_sc|db.replication|7",
+		"_sc||0",
+		"_sc|db.replication|0|d:yesterday",
+	}
+
+	for _, message := range messages {
+		result, err := parseDogStatsDServiceCheck(message)
+
+		if err == nil {
+			t.Error("expected error, got", result)
+		}
+	}
+}
+
+func TestMultipleMessages(t *testing.T) {
+	metrics := make(chan Metric, 10)
+	events := make(chan Event, 10)
+	serviceChecks := make(chan ServiceCheck, 10)
+
+	datagram := "foo:5|g|@1\n_e{5,4}:title|text\nbar:1|c|@0.5|#env:prod\n_sc|check|0"
+
+	for _, message := range splitStatsDMessages(datagram) {
+		parseDogStatsDMessage(message, nil, Sink{Metrics: metrics, Events: events, ServiceChecks: serviceChecks})
+	}
+
+	if len(metrics) != 2 {
+		t.Error("Expected 2 metrics got", len(metrics))
+	}
+
+	if len(events) != 1 {
+		t.Error("Expected 1 event got", len(events))
+	}
+
+	if len(serviceChecks) != 1 {
+		t.Error("Expected 1 service check got", len(serviceChecks))
+	}
+}
@@ -1,22 +1,31 @@
 package input
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 type (
 	/*Metric represents a single time series point
 
-	Type is one of: histogram, counter, gauge or set
+	Type is one of: histogram, counter, gauge, set, timer or distribution
 
 	SecondaryData represents values other than the primary value which should
 	be treated as data and not metadata by the backend storage
 
 	Tags are KV metadata
+
+	Delta marks a gauge value as a change to the current value of the gauge
+	rather than a replacement for it
+
+	SetMember is the member of a set as sent by the client, set members may be
+	strings such as user names as well as numbers
 	*/
 	Metric struct {
 		Name          string
@@ -28,6 +37,8 @@ type (
 		SecondaryData map[string]interface{}
 		Tags          map[string]string
 		Aggregate     bool
+		Delta         bool
+		SetMember     string
 	}
 
 	//MetricBatch represent a batch of individual metrics that have been sent together
@@ -49,19 +60,71 @@ type (
 		SourceType     string
 	}
 
+	/*ServiceCheck represents the status of a single service check
+
+	Status is one of: 0 (OK), 1 (WARNING), 2 (CRITICAL) or 3 (UNKNOWN)
+	*/
+	ServiceCheck struct {
+		Name      string
+		Status    int
+		Host      string
+		Message   string
+		Timestamp float64
+		Tags      map[string]string
+	}
+
 	metricsHTTPHandler struct {
 		metricsIn chan Metric
+		tags      map[string]string
 	}
 
 	eventsHTTPHandler struct {
 		eventsIn chan Event
+		tags     map[string]string
 	}
 
 	metricsBatchHTTPHandler struct {
 		metricsIn chan Metric
+		tags      map[string]string
+	}
+
+	//httpListener serves JSON encoded metrics and events over HTTP
+	httpListener struct {
+		config   ListenerConfig
+		listener net.Listener
+		server   *http.Server
+		done     chan struct{}
+		stopOnce sync.Once
 	}
 )
 
+//UnmarshalJSON decodes a metric whose value is either a number or, for set
+//members, a string
+func (metric *Metric) UnmarshalJSON(data []byte) error {
+	//plainMetric has no UnmarshalJSON method, so it is decoded normally
+	//apart from the value which is decoded here
+	type plainMetric Metric
+	decoded := struct {
+		*plainMetric
+		Value json.RawMessage
+	}{plainMetric: (*plainMetric)(metric)}
+
+	err := json.Unmarshal(data, &decoded)
+
+	if err != nil || len(decoded.Value) == 0 {
+		return err
+	}
+
+	var member string
+	if json.Unmarshal(decoded.Value, &member) == nil {
+		metric.SetMember = member
+		metric.Value, _ = strconv.ParseFloat(member, 64)
+		return nil
+	}
+
+	return json.Unmarshal(decoded.Value, &metric.Value)
+}
+
 //http handler function, unmarshalls json encoded metric into metric struct
 func (handler *metricsHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
@@ -73,7 +136,7 @@ func (handler *metricsHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Requ
 	log.Printf("Received metric from %s\n", sourceIP)
 	receivedMetric.Aggregate = true
 	if err == nil {
-		parseMetric(receivedMetric, sourceIP, handler.metricsIn)
+		parseMetric(receivedMetric, sourceIP, handler.tags, handler.metricsIn)
 	} else {
 		log.Println(err)
 		log.Printf("Unable to decode metric from, %s", sourceAddress)
@@ -97,6 +160,7 @@ func (handler *eventsHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Reque
 
 		//append source address to metric
 		receivedEvent.Tags["source"] = sourceIP
+		receivedEvent.Tags = withDefaultTags(receivedEvent.Tags, handler.tags)
 		handler.eventsIn <- receivedEvent
 	} else {
 		//if unable to parse the metric, drop it. This could be a problem for out of date clients.
@@ -131,7 +195,7 @@ func (handler *metricsBatchHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http
 			log.Printf("metric batch from %s is empty\n", sourceIP)
 		} else {
 			for i := range receivedMetricBatch.Batch {
-				parseMetric(receivedMetricBatch.Batch[i], sourceIP, handler.metricsIn)
+				parseMetric(receivedMetricBatch.Batch[i], sourceIP, handler.tags, handler.metricsIn)
 			}
 		}
 	} else {
@@ -141,7 +205,7 @@ func (handler *metricsBatchHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http
 
 }
 
-func parseMetric(receivedMetric Metric, sourceIP string, metricsIn chan Metric) {
+func parseMetric(receivedMetric Metric, sourceIP string, tags map[string]string, metricsIn chan Metric) {
 	//add an aditional field specifing the host which forwarded aggregateD the metric
 	//this might often be the same as the client specified host field but in situations
 	//where the client is behind NAT, i.e many EVE clients this information is useful.
@@ -159,28 +223,96 @@ func parseMetric(receivedMetric Metric, sourceIP string, metricsIn chan Metric)
 		}
 	}
 
-	receivedMetric.Aggregate = false
+	receivedMetric.Tags = withDefaultTags(receivedMetric.Tags, tags)
+
+	//JSON metrics are written as they were received, apart from sets whose
+	//members, which may be strings, are only meaningful once counted
+	receivedMetric.Aggregate = receivedMetric.Type == "set"
 	metricsIn <- receivedMetric
 }
 
+func init() {
+	Register("json", "tcp", "8003", func(config ListenerConfig) (Listener, error) {
+		l := new(httpListener)
+		l.config = config
+		l.done = make(chan struct{})
+		return l, nil
+	})
+}
+
 //ServeHTTP exposes /events and /metrics and proceses JSON encoded events
 func ServeHTTP(port string, metricsIn chan Metric, eventsIn chan Event) {
+	listener, _ := New("json", ListenerConfig{Port: port})
+	err := listener.Start(context.Background(), Sink{Metrics: metricsIn, Events: eventsIn})
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	select {}
+}
+
+func (l *httpListener) Start(ctx context.Context, sink Sink) error {
 	server := http.NewServeMux()
 
 	metricsHandler := new(metricsHTTPHandler)
-	metricsHandler.metricsIn = metricsIn
+	metricsHandler.metricsIn = sink.Metrics
+	metricsHandler.tags = l.config.Tags
 
 	eventsHandler := new(eventsHTTPHandler)
-	eventsHandler.eventsIn = eventsIn
+	eventsHandler.eventsIn = sink.Events
+	eventsHandler.tags = l.config.Tags
 
 	metricsBatchHandler := new(metricsBatchHTTPHandler)
-	metricsBatchHandler.metricsIn = metricsIn
+	metricsBatchHandler.metricsIn = sink.Metrics
+	metricsBatchHandler.tags = l.config.Tags
 
 	server.Handle("/metrics", metricsHandler)
 	server.Handle("/events", eventsHandler)
 	server.Handle("/metrics_batch", metricsBatchHandler)
 
-	log.Printf("Accepting json metrics on port %s", port)
+	var err error
+	l.listener, err = net.Listen("tcp", net.JoinHostPort(l.config.Address, l.config.Port))
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Accepting json metrics on port %s", l.config.Port)
+
+	l.server = &http.Server{Handler: server}
 
-	log.Fatal(http.ListenAndServe(":"+port, server))
+	go func() {
+		err := l.server.Serve(l.listener)
+
+		select {
+		case <-l.done:
+		default:
+			log.Println(err)
+		}
+	}()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.Stop()
+		case <-l.done:
+		}
+	}()
+
+	return nil
+}
+
+//Stop closes the listener and waits for requests which are being handled to
+//be submitted to the sink
+func (l *httpListener) Stop() error {
+	l.stopOnce.Do(func() {
+		close(l.done)
+	})
+
+	//every caller waits for the requests, shutting down twice is harmless
+	if l.server == nil {
+		return nil
+	}
+	return l.server.Shutdown(context.Background())
 }
@@ -5,8 +5,10 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -21,17 +23,33 @@ func JSONInputTestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
 
+//waitForServer waits for a server started in another goroutine to accept
+//connections, so that requests are not sent before it is listening
+func waitForServer(t *testing.T, address string) {
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("tcp", address)
+
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("server did not start listening on", address)
+}
+
 //TestValidMessage tests the ability of aggregateD recieve properly
 //encoded JSON messages over HTTP
 func TestValidMetric(t *testing.T) {
 	go ServeHTTP("8080", metricsIn, eventsIn)
+	waitForServer(t, "127.0.0.1:8080")
 
 	testMetric := new(Metric)
 	testMetric.Host = "fakehost.example.org"
 	testMetric.Name = "fakemetric"
 	testMetric.Sampling = 1
 	testMetric.Tags = make(map[string]string)
-	testMetric.Timestamp = time.Now().Format("2006-01-02 15:04:05 -0700")
+	testMetric.Timestamp = float64(time.Now().Unix())
 	testMetric.Type = "counter"
 	testMetric.Value = rand.Float64()
 
@@ -63,7 +81,7 @@ func TestMultipleMetrics(t *testing.T) {
 		testMetric.Name = "fakemetric"
 		testMetric.Sampling = 1
 		testMetric.Tags = make(map[string]string)
-		testMetric.Timestamp = time.Now().Format("2006-01-02 15:04:05 -0700")
+		testMetric.Timestamp = float64(time.Now().Unix())
 		testMetric.Type = "counter"
 
 		value := rand.Float64()
@@ -101,11 +119,11 @@ func TestMultipleEvents(t *testing.T) {
 		testEvent.SourceType = "test"
 		testEvent.Text = "something has failed"
 		testEvent.Tags = make(map[string]string)
-		testEvent.Timestamp = time.Now().Format("2006-01-02 15:04:05 -0700")
+		testEvent.Timestamp = float64(time.Now().Unix())
 		testEvent.AggregationKey = "tests"
 
 		hasher := md5.New()
-		randValue := string(rand.Int())
+		randValue := strconv.Itoa(rand.Int())
 
 		hasher.Write([]byte(randValue))
 
@@ -132,3 +150,22 @@ func TestMultipleEvents(t *testing.T) {
 	}
 
 }
+
+func TestStringMetricValue(t *testing.T) {
+	var metric Metric
+	err := json.Unmarshal([]byte(`{"name": "uniques", "type": "set", "value": "user42", "tags": {"env": "prod"}}`), &metric)
+
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	if metric.SetMember != "user42" || metric.Name != "uniques" || metric.Tags["env"] != "prod" {
+		t.Error("Expected set member user42 got", metric)
+	}
+
+	err = json.Unmarshal([]byte(`{"name": "requests", "type": "counter", "value": 67}`), &metric)
+
+	if err != nil || metric.Value != 67 {
+		t.Error("Expected a value of 67 got", metric.Value, err)
+	}
+}
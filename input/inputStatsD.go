@@ -1,43 +1,42 @@
 package input
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"net"
 	"strconv"
 	"strings"
 )
 
-//ServeStatD serves the statsad protocol via UDP.
-func ServeStatD(port string, metricsIn chan Metric) string {
-	var buf [1024]byte
-	addr, err := net.ResolveUDPAddr("udp", ":"+port)
-
-	if err != nil {
-		panic(err)
-	}
+func init() {
+	//plain StatsD has its own default port, so that it may run alongside
+	//DogStatsD on 8125 without being configured
+	Register("statsd", "udp", "8126", func(config ListenerConfig) (Listener, error) {
+		return newUDPListener(config, handleStatsDMessage), nil
+	})
+}
 
-	sock, err := net.ListenUDP("udp", addr)
+//ServeStatD serves the statsad protocol via UDP. bufferSize is the largest
+//datagram which can be read, anything beyond it is truncated by the socket.
+func ServeStatD(port string, bufferSize int, metricsIn chan Metric) string {
+	listener, _ := New("statsd", ListenerConfig{Port: port, BufferSize: bufferSize})
+	err := listener.Start(context.Background(), Sink{Metrics: metricsIn})
 
 	if err != nil {
 		panic(err)
 	}
 
-	for {
-		rlen, _, _ := sock.ReadFromUDP(buf[:])
-		message := string(buf[:rlen])
-		//a single statsD message can contain multiple metrics
-		//split and then interate through each to parse and submit
-		//for aggregategation
-		metrics := splitStatsDMessages(message)
+	select {}
+}
 
-		for _, metric := range metrics {
-			parsedMetric, err := parseStatDMetric(metric)
+//handleStatsDMessage parses a single statsD metric and submits it, plain
+//statsD has no events or service checks
+func handleStatsDMessage(message string, tags map[string]string, sink Sink) {
+	parsedMetric, err := parseStatDMetric(message)
 
-			if err == nil {
-				metricsIn <- parsedMetric
-			}
-		}
+	if err == nil {
+		parsedMetric.Tags = withDefaultTags(parsedMetric.Tags, tags)
+		sink.Metrics <- parsedMetric
 	}
 }
 
@@ -63,36 +62,44 @@ func splitStatsDMessages(messages string) []string {
 
 func parseStatDMetric(message string) (Metric, error) {
 	var metric Metric
+	metric.Aggregate = true
 
 	colonIndex := strings.Index(message, ":")
 	ibarIndex := strings.Index(message, "|")
-	atIndex := strings.Index(message, "@")
 
-	if colonIndex == -1 || ibarIndex == -1 {
+	if colonIndex == -1 || ibarIndex == -1 || ibarIndex < colonIndex {
 		return Metric{}, errors.New("unable to parse name from statsD message")
 	}
 
+	//set members may contain an @, so the sample rate is only looked for
+	//after the value
+	atIndex := strings.Index(message[ibarIndex:], "@")
+	if atIndex != -1 {
+		atIndex += ibarIndex
+	}
+
 	metric.Name = string(message[:colonIndex])
 	stringValue := message[colonIndex+1 : ibarIndex]
-	floatValue, err := strconv.ParseFloat(stringValue, 64)
+	floatValue, valueErr := strconv.ParseFloat(stringValue, 64)
 	metric.Value = floatValue
 
-	if err != nil {
-		return Metric{}, errors.New("unable to parse value from statsD message")
-	}
-
 	metricType := ""
 
 	if atIndex == -1 {
 		metricType = message[ibarIndex+1 : len(message)]
 		metric.Sampling = 1
 	} else {
+		//the sample rate follows the type, i.e. |c|@0.1
+		if atIndex-1 <= ibarIndex {
+			return Metric{}, errors.New("unable to parse StatsD metric type")
+		}
+
 		metricType = message[ibarIndex+1 : atIndex-1]
 		sampleRate := message[atIndex+1 : len(message)]
 		floatSampleRate, err := strconv.ParseFloat(sampleRate, 64)
 
-		if err != nil {
-			return Metric{}, errors.New("unable to parse StatsD value")
+		if err != nil || floatSampleRate <= 0 || floatSampleRate > 1 {
+			return Metric{}, errors.New("unable to parse StatsD sample rate")
 		}
 
 		metric.Sampling = floatSampleRate
@@ -103,12 +110,31 @@ func parseStatDMetric(message string) (Metric, error) {
 		metric.Type = "timer"
 	case "g":
 		metric.Type = "gauge"
+		metric.Delta = isGaugeDelta(stringValue)
 	case "c":
 		metric.Type = "counter"
+	case "s":
+		metric.Type = "set"
+		metric.SetMember = stringValue
+	case "h":
+		metric.Type = "histogram"
+	case "d":
+		metric.Type = "distribution"
 	default:
-		err = fmt.Errorf("invalid metric type: %q", metricType)
+		err := fmt.Errorf("invalid metric type: %q", metricType)
 		return metric, err
 	}
 
+	//set members are counted as strings, so they need not be numbers
+	if valueErr != nil && metric.Type != "set" {
+		return Metric{}, errors.New("unable to parse value from statsD message")
+	}
+
 	return metric, nil
 }
+
+//isGaugeDelta reports whether a gauge value is signed, statsD treats signed
+//gauge values as a change to the current value, i.e. gauge:+5|g and gauge:-3|g
+func isGaugeDelta(value string) bool {
+	return strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-")
+}
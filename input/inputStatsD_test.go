@@ -43,3 +43,99 @@ func TestSplitMessages(t *testing.T) {
 		t.Error("Exected foobar got", parsedResult.Name)
 	}
 }
+
+func TestMetricTypes(t *testing.T) {
+	expected := map[string]string{
+		"uniques:765|s":           "set",
+		"response.size:512|h":     "histogram",
+		"request.time:320|d":      "distribution",
+		"request.time:320|ms":     "timer",
+		"request.time:320|d|@0.1": "distribution",
+	}
+
+	for message, metricType := range expected {
+		metric, err := parseStatDMetric(message)
+
+		if err != nil {
+			t.Error("unexpected error parsing", message, err)
+		}
+
+		if metric.Type != metricType {
+			t.Errorf("Expected %s to be a %s got %s", message, metricType, metric.Type)
+		}
+	}
+}
+
+func TestGaugeDelta(t *testing.T) {
+	metric, _ := parseStatDMetric("connections:+5|g")
+
+	if !metric.Delta || metric.Value != 5 {
+		t.Error("Expected a delta of 5 got", metric.Delta, metric.Value)
+	}
+
+	metric, _ = parseStatDMetric("connections:-3|g")
+
+	if !metric.Delta || metric.Value != -3 {
+		t.Error("Expected a delta of -3 got", metric.Delta, metric.Value)
+	}
+
+	metric, _ = parseStatDMetric("connections:3|g")
+
+	if metric.Delta {
+		t.Error("Expected an unsigned gauge not to be a delta")
+	}
+
+	metric, _ = parseStatDMetric("errors:-1|c")
+
+	if metric.Delta {
+		t.Error("Expected a signed counter not to be a delta")
+	}
+
+	metric, _ = parseDogStatsDMetric("connections:-3|g|#env:prod")
+
+	if !metric.Delta || metric.Value != -3 {
+		t.Error("Expected a DogStatsD delta of -3 got", metric.Delta, metric.Value)
+	}
+}
+
+func TestStringSetMember(t *testing.T) {
+	metric, err := parseStatDMetric("uniques:user@example.com|s")
+
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	if metric.SetMember != "user@example.com" {
+		t.Error("Expected set member user@example.com got", metric.SetMember)
+	}
+
+	metric, err = parseDogStatsDMetric("uniques:user42|s|#env:prod")
+
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	if metric.SetMember != "user42" {
+		t.Error("Expected set member user42 got", metric.SetMember)
+	}
+
+	_, err = parseStatDMetric("requests:many|c")
+
+	if err == nil {
+		t.Error("Expected a non numeric counter to be invalid")
+	}
+}
+
+func TestInvalidSampleRates(t *testing.T) {
+	for _, message := range []string{"a:1|@0.5", "a:1|c|@0", "a:1|c|@-1", "a:1|c|@1.5", "a:1|c|@rate"} {
+		if _, err := parseStatDMetric(message); err == nil {
+			t.Error("Expected an error parsing", message)
+		}
+	}
+
+	metric, err := parseStatDMetric("a:1|c|@0.5")
+
+	if err != nil || metric.Sampling != 0.5 {
+		t.Error("Expected a sample rate of 0.5 got", metric.Sampling, err)
+	}
+}
@@ -0,0 +1,197 @@
+package input
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+)
+
+type (
+	//Listener receives metrics, events and service checks from clients,
+	//listeners are created from the config by the factory of their type
+	Listener interface {
+		//Start begins listening, it returns once the listener is bound and
+		//receives in the background until Stop is called or ctx is done
+		Start(ctx context.Context, sink Sink) error
+		Stop() error
+	}
+
+	//Sink is where listeners submit everything they receive
+	Sink struct {
+		Metrics       chan Metric
+		Events        chan Event
+		ServiceChecks chan ServiceCheck
+	}
+
+	//ListenerConfig is the configuration common to every type of listener
+	ListenerConfig struct {
+		//Address is the address to bind to, all addresses if empty
+		Address string
+		Port    string
+		//BufferSize is the largest datagram UDP listeners can read, anything
+		//beyond it is truncated by the socket
+		BufferSize int
+		//Tags are added to everything received, unless the client has
+		//set the same tag
+		Tags map[string]string
+	}
+
+	//Factory creates a listener from its config
+	Factory func(config ListenerConfig) (Listener, error)
+
+	registration struct {
+		network     string
+		defaultPort string
+		factory     Factory
+	}
+
+	//udpListener reads datagrams from a UDP socket, handle is called for
+	//each newline delimited message in a datagram
+	udpListener struct {
+		config   ListenerConfig
+		handle   func(message string, tags map[string]string, sink Sink)
+		sock     *net.UDPConn
+		done     chan struct{}
+		stopOnce sync.Once
+		//served is closed once the last datagram has been handled
+		served chan struct{}
+	}
+)
+
+var listeners = make(map[string]registration)
+
+//Register makes a listener type available to the config, it is intended to
+//be called from the init function of the file implementing the listener.
+//network is udp or tcp, listeners on different networks may share a port
+func Register(listenerType string, network string, defaultPort string, factory Factory) {
+	if _, exists := listeners[listenerType]; exists {
+		panic("listener type " + listenerType + " registered twice")
+	}
+	listeners[listenerType] = registration{network: network, defaultPort: defaultPort, factory: factory}
+}
+
+//Network returns the network a type of listener listens on
+func Network(listenerType string) string {
+	return listeners[listenerType].network
+}
+
+//DefaultPort returns the port a type of listener uses when none is configured
+func DefaultPort(listenerType string) string {
+	return listeners[listenerType].defaultPort
+}
+
+//New creates a listener of a registered type
+func New(listenerType string, config ListenerConfig) (Listener, error) {
+	registered, ok := listeners[listenerType]
+
+	if !ok {
+		return nil, fmt.Errorf("unknown input type %q", listenerType)
+	}
+
+	if config.Port == "" {
+		config.Port = registered.defaultPort
+	}
+
+	return registered.factory(config)
+}
+
+//withDefaultTags adds the default tags of a listener to the tags sent by a
+//client, tags sent by the client take precedence
+func withDefaultTags(tags map[string]string, defaults map[string]string) map[string]string {
+	if len(defaults) == 0 {
+		return tags
+	}
+
+	if tags == nil {
+		tags = make(map[string]string, len(defaults))
+	}
+
+	for k, v := range defaults {
+		if _, ok := tags[k]; !ok {
+			tags[k] = v
+		}
+	}
+
+	return tags
+}
+
+func newUDPListener(config ListenerConfig, handle func(string, map[string]string, Sink)) *udpListener {
+	l := new(udpListener)
+	l.config = config
+	l.handle = handle
+	l.done = make(chan struct{})
+	l.served = make(chan struct{})
+	return l
+}
+
+func (l *udpListener) Start(ctx context.Context, sink Sink) error {
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(l.config.Address, l.config.Port))
+
+	if err != nil {
+		return err
+	}
+
+	l.sock, err = net.ListenUDP("udp", addr)
+
+	if err != nil {
+		return err
+	}
+
+	go l.serve(sink)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.Stop()
+		case <-l.done:
+		}
+	}()
+
+	return nil
+}
+
+func (l *udpListener) serve(sink Sink) {
+	defer close(l.served)
+	buf := make([]byte, l.config.BufferSize)
+
+	for {
+		rlen, _, err := l.sock.ReadFromUDP(buf)
+
+		if err != nil {
+			select {
+			case <-l.done:
+				return
+			default:
+				log.Println(err)
+				continue
+			}
+		}
+
+		//a single datagram can contain multiple messages, split and then
+		//interate through each to parse and submit for aggregation
+		for _, message := range splitStatsDMessages(string(buf[:rlen])) {
+			l.handle(message, l.config.Tags, sink)
+		}
+	}
+}
+
+//Stop closes the socket and waits for the datagram being handled, if any,
+//to be submitted to the sink
+func (l *udpListener) Stop() error {
+	var err error
+
+	l.stopOnce.Do(func() {
+		close(l.done)
+		if l.sock != nil {
+			err = l.sock.Close()
+		}
+	})
+
+	if l.sock != nil {
+		<-l.served
+	}
+
+	return err
+}
@@ -0,0 +1,131 @@
+package input
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultTags(t *testing.T) {
+	tags := withDefaultTags(map[string]string{"tenant": "api"}, map[string]string{"tenant": "web", "region": "eu"})
+
+	if tags["tenant"] != "api" {
+		t.Error("Expected the client's tag to take precedence got", tags["tenant"])
+	}
+
+	if tags["region"] != "eu" {
+		t.Error("Expected the default tag to be added got", tags["region"])
+	}
+
+	if tags = withDefaultTags(nil, map[string]string{"region": "eu"}); tags["region"] != "eu" {
+		t.Error("Expected default tags for a metric without tags got", tags)
+	}
+}
+
+func TestUDPListener(t *testing.T) {
+	listener, err := New("statsd", ListenerConfig{Address: "127.0.0.1", Port: "18125", BufferSize: 1024, Tags: map[string]string{"tenant": "web"}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	metrics := make(chan Metric, 1)
+
+	if err := listener.Start(ctx, Sink{Metrics: metrics}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("udp", "127.0.0.1:18125")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("requests:1|c"))
+
+	select {
+	case metric := <-metrics:
+		if metric.Name != "requests" || metric.Tags["tenant"] != "web" {
+			t.Error("Expected requests tagged with tenant web got", metric)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a metric from the listener")
+	}
+
+	//once the context is done the port is released
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+
+	listener, _ = New("statsd", ListenerConfig{Address: "127.0.0.1", Port: "18125", BufferSize: 1024})
+
+	if err := listener.Start(context.Background(), Sink{Metrics: metrics}); err != nil {
+		t.Error("Expected the port to be released when the context is done, got", err)
+	}
+	listener.Stop()
+}
+
+//expectStopWaits stops listener while a metric is waiting to be received from
+//metrics and checks that Stop only returns once the metric has been received
+func expectStopWaits(t *testing.T, listener Listener, metrics chan Metric) {
+	//give the input time to block on the unbuffered channel
+	time.Sleep(50 * time.Millisecond)
+
+	stopped := make(chan struct{})
+
+	go func() {
+		listener.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		t.Fatal("Expected Stop to wait for the metric being handled")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if metric := <-metrics; metric.Name != "requests" {
+		t.Error("Expected requests got", metric)
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Expected Stop to return once the metric was received")
+	}
+}
+
+func TestUDPStopWaits(t *testing.T) {
+	listener, _ := New("statsd", ListenerConfig{Address: "127.0.0.1", Port: "18126", BufferSize: 1024})
+	metrics := make(chan Metric)
+
+	if err := listener.Start(context.Background(), Sink{Metrics: metrics}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("udp", "127.0.0.1:18126")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("requests:1|c"))
+
+	expectStopWaits(t, listener, metrics)
+}
+
+func TestJSONStopWaits(t *testing.T) {
+	listener, _ := New("json", ListenerConfig{Address: "127.0.0.1", Port: "18004"})
+	metrics := make(chan Metric)
+
+	if err := listener.Start(context.Background(), Sink{Metrics: metrics}); err != nil {
+		t.Fatal(err)
+	}
+
+	go http.Post("http://127.0.0.1:18004/metrics", "application/json", strings.NewReader(`{"name": "requests", "type": "counter", "value": 1}`))
+
+	expectStopWaits(t, listener, metrics)
+}
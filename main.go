@@ -1,12 +1,20 @@
 package main
 
 import (
-	"encoding/json"
+	"bytes"
+	"context"
 	"flag"
 	"log"
+	"math"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/ccpgames/aggregateD/config"
+	"github.com/ccpgames/aggregateD/health"
 	"github.com/ccpgames/aggregateD/input"
 	"github.com/ccpgames/aggregateD/output"
 )
@@ -21,30 +29,37 @@ type (
 		AggregationKey string
 	}
 
-	//metricKey is used to index the map of metrics, this is used in liue of metric
-	//names as doing so would risk unrelated metrics which share the same name being aggregated
-	//the metric key ensures that metrics with the same name, tags and secondary data are aggregated.
-	metricKey struct {
-		Name          string
-		Tags          string
-		SecondaryData string
+	//serviceCheckKey is used as the key in the map of service checks, a check
+	//is identified by its name, the host it is reported for and its tags
+	serviceCheckKey struct {
+		Name string
+		Host string
+		Tags string
 	}
 
 	//Main represents the top level program execution which predominantly
 	//includes the aggregation process. Inputs and outputs are done by other modules
+	//and metrics are aggregated by shards, Main routes each metric to its shard
 	Main struct {
 		metricsIn           chan input.Metric
 		eventsIn            chan input.Event
-		metricBuckets       map[metricKey][]timestampedBucket
+		serviceChecksIn     chan input.ServiceCheck
+		shards              []*shard
 		unaggregatedMetrics []output.Bucket
 		eventBuckets        map[eventKey]*output.Bucket
-		aggregators         map[string]func(input.Metric, *output.Bucket)
-	}
-
-	timestampedBucket struct {
-		StartTimestamp int
-		EndTimestamp   int
-		MetricBucket   *output.Bucket
+		serviceCheckBuckets map[serviceCheckKey]*output.Bucket
+		lateSamples         int64
+		//flushes are queued for the writer goroutines, so that aggregation
+		//never waits for outputs
+		flushes *output.Queue
+		writers sync.WaitGroup
+		//failedWrites counts writes to any output which failed, it is
+		//updated atomically by the writers
+		failedWrites uint64
+		//stopReplays is closed to stop replaying the Redis fallbacks, which
+		//must finish before the outputs are closed
+		stopReplays chan struct{}
+		replays     sync.WaitGroup
 	}
 )
 
@@ -52,86 +67,171 @@ var (
 	configuration config.Configuration
 )
 
-func (m *Main) aggregate() {
+//aggregate receives from the inputs and flushes every flush interval until
+//aggregateD is asked to stop
+func (m *Main) aggregate(signals <-chan os.Signal) {
 	t := time.NewTicker(time.Duration(configuration.FlushInterval) * time.Second)
+	defer t.Stop()
+
 	for {
 		select {
 		case <-t.C:
-			m.flush()
+			//windows are only written once they have closed and any late metrics
+			//have had a chance to arrive, open windows are kept until the next flush
+			m.flush(int(time.Now().Unix()) - configuration.LatenessTolerance)
 		case receivedMetric := <-m.metricsIn:
-			if receivedMetric.Aggregate {
-				m.aggregateMetric(receivedMetric)
-			} else {
-				outputMetric := new(output.Bucket)
-				outputMetric.Name = receivedMetric.Name
-				outputMetric.Timestamp = parseTimestamp(receivedMetric.Timestamp)
-				outputMetric.Fields = receivedMetric.SecondaryData
-				outputMetric.Fields["value"] = receivedMetric.Value
-				outputMetric.Tags = receivedMetric.Tags
-				outputMetric.Values = append(outputMetric.Values, receivedMetric.Value)
-				m.unaggregatedMetrics = append(m.unaggregatedMetrics, *outputMetric)
-			}
+			m.receiveMetric(receivedMetric)
 		case receivedEvent := <-m.eventsIn:
 			m.aggregateEvent(receivedEvent)
+		case receivedServiceCheck := <-m.serviceChecksIn:
+			m.aggregateServiceCheck(receivedServiceCheck)
+		case received := <-signals:
+			log.Printf("Received %s, shutting down", received)
+			return
 		}
 	}
 }
 
-//aggregate metrics into a single bucket, makes use of aggregators
-//to aggregate different metric types
-func (m *Main) aggregateMetric(receivedMetric input.Metric) {
-	//if a handler exists to aggregate the metric, do so
-	//otherwise ignore the metric
-	if receivedMetric.Name == "" {
-		log.Printf("Invalid metric recieved from %s, missing name", receivedMetric.SecondaryData["source"])
-		return
-	} else if receivedMetric.Type == "" {
-		log.Printf("Invalid metric recieved from %s, missing type", receivedMetric.SecondaryData["source"])
+//receiveMetric routes a metric to its shard or, if it is not to be
+//aggregated, keeps it to be written as is
+func (m *Main) receiveMetric(receivedMetric input.Metric) {
+	if receivedMetric.Aggregate {
+		m.routeMetric(receivedMetric)
 		return
 	}
 
-	/*this is a bit of a hack, in order to compare tags and ensure that metrics with
-	distinct tags and secondary data are not aggregated they are used as part of the key. Unfortunately
-	go doesn't allow for maps to be used in a key, therefore we serialise the map
-	to a json string and use that instead of the map. Sorry. */
-	if handler, handlerOK := m.aggregators[receivedMetric.Type]; handlerOK {
-		key := *(new(metricKey))
-		key.Name = receivedMetric.Name
+	outputMetric := new(output.Bucket)
+	outputMetric.Name = receivedMetric.Name
+	outputMetric.Timestamp = parseTimestamp(receivedMetric.Timestamp)
+	outputMetric.Fields = receivedMetric.SecondaryData
+	outputMetric.Fields["value"] = receivedMetric.Value
+	outputMetric.Tags = receivedMetric.Tags
+	outputMetric.Values = append(outputMetric.Values, receivedMetric.Value)
+	m.unaggregatedMetrics = append(m.unaggregatedMetrics, *outputMetric)
+}
 
-		jsonTagMap, _ := json.Marshal(receivedMetric.Tags)
-		jsonSecondaryDataMap, _ := json.Marshal(receivedMetric.SecondaryData)
+//stopInputs stops the inputs, receiving from them until every input has
+//stopped so that inputs waiting on a full channel can finish submitting
+func (m *Main) stopInputs() {
+	stopped := make(chan struct{})
 
-		key.Tags = string(jsonTagMap)
-		key.SecondaryData = string(jsonSecondaryDataMap)
+	go func() {
+		for _, listener := range configuration.Inputs {
+			listener.Stop()
+		}
+		close(stopped)
+	}()
+
+	for {
+		select {
+		case receivedMetric := <-m.metricsIn:
+			m.receiveMetric(receivedMetric)
+		case receivedEvent := <-m.eventsIn:
+			m.aggregateEvent(receivedEvent)
+		case receivedServiceCheck := <-m.serviceChecksIn:
+			m.aggregateServiceCheck(receivedServiceCheck)
+		case <-stopped:
+			return
+		}
+	}
+}
 
-		_, outerBucketSliceOK := m.metricBuckets[key]
-		var outerBucket timestampedBucket
+//drain receives everything the inputs submitted before they were stopped
+func (m *Main) drain() {
+	for {
+		select {
+		case receivedMetric := <-m.metricsIn:
+			m.receiveMetric(receivedMetric)
+		case receivedEvent := <-m.eventsIn:
+			m.aggregateEvent(receivedEvent)
+		case receivedServiceCheck := <-m.serviceChecksIn:
+			m.aggregateServiceCheck(receivedServiceCheck)
+		default:
+			return
+		}
+	}
+}
 
-		//if this metric isn't know create a new bucket for it
-		if !outerBucketSliceOK {
-			outerBucket = *new(timestampedBucket)
-			m.metricBuckets[key] = *new([]timestampedBucket)
+//shutdown stops the inputs and Redis replays and writes everything which has been received,
+//including windows which are still open. It returns false if anything could
+//not be written before the shutdown timeout
+func (m *Main) shutdown() bool {
+	written := make(chan bool, 1)
+
+	go func() {
+		dropped := m.flushes.Dropped()
+		failed := atomic.LoadUint64(&m.failedWrites)
+
+		close(m.stopReplays)
+		m.stopInputs()
+		m.drain()
+		m.flush(math.MaxInt32)
+		m.flushes.Close()
+		m.writers.Wait()
+		m.replays.Wait()
+
+		for _, writer := range configuration.Outputs {
+			writer.Close()
 		}
 
-		innerBucket, innerBucketOK := getBucket(int(receivedMetric.Timestamp), m.metricBuckets[key])
-
-		//if metric falls outside the time range we already have, make a new timestamped bucket
-		//i.e. no inner bucket means no outer bucket
-		if !innerBucketOK {
-			innerBucket = new(output.Bucket)
-			outerBucket.StartTimestamp = int(receivedMetric.Timestamp)
-			//tempoary for testing, change 10 to config specified variable
-			outerBucket.EndTimestamp = int(receivedMetric.Timestamp) + configuration.AggregationInterval
-			innerBucket.Name = receivedMetric.Name
-			innerBucket.Fields = receivedMetric.SecondaryData
-			innerBucket.Tags = receivedMetric.Tags
-			outerBucket.MetricBucket = innerBucket
-			m.metricBuckets[key] = append(m.metricBuckets[key], outerBucket)
+		written <- m.flushes.Dropped() == dropped && atomic.LoadUint64(&m.failedWrites) == failed
+	}()
+
+	select {
+	case ok := <-written:
+		if !ok {
+			log.Println("WARNING: final flush failed, metrics have been dropped")
 		}
+		return ok
+	case <-time.After(time.Duration(configuration.ShutdownTimeout) * time.Second):
+		log.Printf("WARNING: final flush did not complete within %d seconds", configuration.ShutdownTimeout)
+		return false
+	}
+}
+
+//newMain returns a Main whose channels and maps are ready to be used
+func newMain() *Main {
+	m := new(Main)
+
+	m.metricsIn = make(chan input.Metric, 10000)
+	m.eventsIn = make(chan input.Event, 10000)
+	m.serviceChecksIn = make(chan input.ServiceCheck, 10000)
+	m.eventBuckets = make(map[eventKey]*output.Bucket)
+	m.serviceCheckBuckets = make(map[serviceCheckKey]*output.Bucket)
+	m.stopReplays = make(chan struct{})
+	return m
+}
+
+//startReplays replays the Redis fallbacks of InfluxDB outputs, if there are
+//any, until shutdown closes stopReplays
+func (m *Main) startReplays() {
+	if len(configuration.RedisReplays) == 0 {
+		return
+	}
+
+	stop := m.stopReplays
+	m.replays.Add(1)
 
-		handler(receivedMetric, innerBucket)
+	go func() {
+		defer m.replays.Done()
+		replayRedis(stop)
+	}()
+}
 
+//routeMetric sends a metric to the shard which owns its series
+func (m *Main) routeMetric(receivedMetric input.Metric) {
+	if receivedMetric.Name == "" {
+		log.Printf("Invalid metric recieved from %s, missing name", receivedMetric.SecondaryData["source"])
+		return
+	} else if receivedMetric.Type == "" {
+		log.Printf("Invalid metric recieved from %s, missing type", receivedMetric.SecondaryData["source"])
+		return
 	}
+
+	//the series key ensures that metrics with distinct tags are not aggregated
+	key := newSeriesKey(receivedMetric, configuration.SeriesIdentityFields)
+	owner := m.shards[key.Hash%uint64(len(m.shards))]
+	owner.metricsIn <- keyedMetric{key: key, metric: receivedMetric}
 }
 
 //aggregate multiple events into one bucket
@@ -154,11 +254,10 @@ func (m *Main) aggregateEvent(receivedEvent input.Event) {
 	_, ok := m.eventBuckets[key]
 
 	if !ok {
-		m.eventBuckets[key].Timestamp = parseTimestamp(receivedEvent.Timestamp)
 		m.eventBuckets[key] = new(output.Bucket)
 		m.eventBuckets[key].Name = receivedEvent.Name
 		m.eventBuckets[key].Fields = make(map[string]interface{})
-		m.eventBuckets[key].Tags = receivedEvent.Tags
+		m.eventBuckets[key].Tags = make(map[string]string)
 	}
 
 	m.eventBuckets[key].Fields["name"] = receivedEvent.Name
@@ -167,6 +266,7 @@ func (m *Main) aggregateEvent(receivedEvent input.Event) {
 	m.eventBuckets[key].Fields["aggregation_key"] = receivedEvent.AggregationKey
 	m.eventBuckets[key].Fields["priority"] = receivedEvent.Priority
 	m.eventBuckets[key].Fields["alert_type"] = receivedEvent.AlertType
+	m.eventBuckets[key].Fields["source_type"] = receivedEvent.SourceType
 
 	m.eventBuckets[key].Timestamp = parseTimestamp(receivedEvent.Timestamp)
 
@@ -175,48 +275,103 @@ func (m *Main) aggregateEvent(receivedEvent input.Event) {
 	}
 }
 
-//write out aggregated buckets to one or more outputs and clear the metric and event
-//dictionaries
-func (m *Main) flush() {
+//aggregate service checks into one bucket per check, only the most recent
+//status of a check within a flush interval is kept
+func (m *Main) aggregateServiceCheck(receivedServiceCheck input.ServiceCheck) {
+	if receivedServiceCheck.Name == "" {
+		log.Printf("Invalid service check recieved from %s, missing name", receivedServiceCheck.Host)
+		return
+	}
+
+	key := *(new(serviceCheckKey))
+	key.Name = receivedServiceCheck.Name
+	key.Host = receivedServiceCheck.Host
+
+	var tags bytes.Buffer
+	encodeTags(&tags, receivedServiceCheck.Tags)
+	key.Tags = tags.String()
+
+	bucket, ok := m.serviceCheckBuckets[key]
+	timestamp := parseTimestamp(receivedServiceCheck.Timestamp)
+
+	//a check which arrives out of order should not overwrite a newer status
+	if ok && timestamp.Before(bucket.Timestamp) {
+		return
+	}
+
+	if !ok {
+		bucket = new(output.Bucket)
+		bucket.Name = receivedServiceCheck.Name
+		bucket.Fields = make(map[string]interface{})
+		bucket.Tags = make(map[string]string)
+		m.serviceCheckBuckets[key] = bucket
+	}
+
+	bucket.Timestamp = timestamp
+	bucket.Fields["status"] = receivedServiceCheck.Status
+	bucket.Fields["host"] = receivedServiceCheck.Host
+	bucket.Fields["message"] = receivedServiceCheck.Message
+
+	for k, v := range receivedServiceCheck.Tags {
+		bucket.Tags[k] = v
+	}
+}
+
+//collect the windows which ended at or before cutoff from every shard along
+//with the events and service checks, and queue them for the writers
+func (m *Main) flush(cutoff int) {
 	var outputBuckets []output.Bucket
+	flushed := make(chan shardFlush, len(m.shards))
 
-	for _, v := range m.metricBuckets {
-		for i := range v {
-			outputBuckets = append(outputBuckets, *v[i].MetricBucket)
-		}
+	for _, s := range m.shards {
+		s.flushRequests <- flushRequest{cutoff: cutoff, flushed: flushed}
+	}
+
+	m.lateSamples = 0
+	for range m.shards {
+		shardBuckets := <-flushed
+		outputBuckets = append(outputBuckets, shardBuckets.buckets...)
+		m.lateSamples += shardBuckets.lateSamples
 	}
 
 	for _, event := range m.eventBuckets {
 		outputBuckets = append(outputBuckets, *event)
 	}
 
-	outputBuckets = append(outputBuckets, m.unaggregatedMetrics...)
-	if len(configuration.InfluxConfig.InfluxURL) > 0 {
-		if len(outputBuckets) > 0 {
-
-			influxdbErr := output.WriteToInfluxDB(outputBuckets, configuration.InfluxConfig)
-
-			if influxdbErr != nil {
-				if len(configuration.RedisOutputURL.String()) > 0 {
-					log.Printf("InfluxDB write failed, attempting to write %d points to Redis", len(outputBuckets))
-					redisErr := output.WriteRedis(outputBuckets, configuration.RedisOutputURL)
-					if redisErr != nil {
-						log.Println("WARNING: Redis write failed, metrics have been dropped")
-					}
-				}
-			}
-		}
+	for _, serviceCheck := range m.serviceCheckBuckets {
+		outputBuckets = append(outputBuckets, *serviceCheck)
 	}
 
-	if len(configuration.JSONOutputURL.String()) > 0 {
-		output.WriteJSON(outputBuckets, configuration.JSONOutputURL)
-	}
+	outputBuckets = append(outputBuckets, m.unaggregatedMetrics...)
+	outputBuckets = append(outputBuckets, m.internalBuckets()...)
+	m.flushes.Push(outputBuckets)
 
-	m.metricBuckets = make(map[metricKey][]timestampedBucket)
 	m.eventBuckets = make(map[eventKey]*output.Bucket)
+	m.serviceCheckBuckets = make(map[serviceCheckKey]*output.Bucket)
 	m.unaggregatedMetrics = nil
 }
 
+//write out queued buckets to one or more outputs
+func (m *Main) write() {
+	defer m.writers.Done()
+
+	for outputBuckets := range m.flushes.Batches() {
+		if len(outputBuckets) == 0 {
+			continue
+		}
+
+		//each output handles its own failures, including writing to its fallback
+		for _, writer := range configuration.Outputs {
+			err := writer.Write(outputBuckets)
+
+			if err != nil {
+				atomic.AddUint64(&m.failedWrites, 1)
+				log.Printf("WARNING: %s write failed, %d points have been dropped", writer.Name(), len(output.FailedBuckets(outputBuckets, err)))
+			}
+		}
+	}
+}
+
 /*parseTimestamp parses a UNIX timestamp from a float to
 a Go time.Time type */
 func parseTimestamp(timestamp float64) time.Time {
@@ -227,15 +382,56 @@ func parseTimestamp(timestamp float64) time.Time {
 
 }
 
-func getBucket(timestamp int, buckets []timestampedBucket) (*output.Bucket, bool) {
+//internalBuckets reports aggregateD's own counters so that problems such as
+//malformed client input are visible alongside the metrics themselves
+func (m *Main) internalBuckets() []output.Bucket {
+	dogStatsD := output.Bucket{
+		Name:      "aggregated.dogstatsd",
+		Timestamp: time.Now(),
+		Tags:      make(map[string]string),
+		Fields: map[string]interface{}{
+			"parse_errors": int64(input.DogStatsDParseErrors()),
+		},
+	}
 
-	for i := range buckets {
-		if timestamp >= buckets[i].StartTimestamp && timestamp <= buckets[i].EndTimestamp {
-			return buckets[i].MetricBucket, true
-		}
+	aggregation := output.Bucket{
+		Name:      "aggregated.aggregation",
+		Timestamp: time.Now(),
+		Tags:      make(map[string]string),
+		Fields: map[string]interface{}{
+			"late_samples": m.lateSamples,
+		},
+	}
+
+	outputQueue := output.Bucket{
+		Name:      "aggregated.output",
+		Timestamp: time.Now(),
+		Tags:      make(map[string]string),
+		Fields: map[string]interface{}{
+			"queue_length":    int64(m.flushes.Len()),
+			"dropped_batches": int64(m.flushes.Dropped()),
+		},
 	}
 
-	return nil, false
+	writtenChunks, failedChunks := output.InfluxDBChunks()
+	influxDB := output.Bucket{
+		Name:      "aggregated.influxdb",
+		Timestamp: time.Now(),
+		Tags:      make(map[string]string),
+		Fields: map[string]interface{}{
+			"written_chunks": int64(writtenChunks),
+			"failed_chunks":  int64(failedChunks),
+		},
+	}
+
+	return []output.Bucket{dogStatsD, aggregation, outputQueue, influxDB}
+}
+
+//windowStart returns the start of the aggregation window a timestamp falls in,
+//windows are aligned to multiples of the aggregation interval so that points
+//from different hosts and metrics share the same timestamps
+func windowStart(timestamp int) int {
+	return timestamp - timestamp%configuration.AggregationInterval
 }
 
 func main() {
@@ -250,21 +446,56 @@ func main() {
 		panic("Unable to read config")
 	}
 
-	m := new(Main)
+	m := newMain()
+	configuration = config.ParseConfig(configFile)
 
-	m.aggregators = map[string]func(input.Metric, *output.Bucket){
-		"gauge":     m.gaugeAggregator,
-		"set":       m.setAggregator,
-		"counter":   m.counterAggregator,
-		"histogram": m.histogramAggregator,
+	switch flag.Arg(0) {
+	case "":
+	case "replay-redis":
+		if !replayRedisOnce() {
+			os.Exit(1)
+		}
+		return
+	default:
+		log.Fatalf("Unknown command %s, the only command is replay-redis", flag.Arg(0))
 	}
 
-	m.metricsIn = make(chan input.Metric, 10000)
-	m.eventsIn = make(chan input.Event, 10000)
-	m.metricBuckets = make(map[metricKey][]timestampedBucket)
-	m.eventBuckets = make(map[eventKey]*output.Bucket)
+	if configuration.HealthCheck {
+		go health.Serve(configuration.InfluxConfig, configuration.Breakers)
+	}
+
+	m.startReplays()
+	m.flushes = output.NewQueue(configuration.OutputQueueDepth, configuration.OutputQueueDropPolicy)
+
+	for i := 0; i < configuration.AggregationShards; i++ {
+		s := newShard()
+		m.shards = append(m.shards, s)
+		go s.run()
+	}
+
+	for i := 0; i < configuration.OutputWriters; i++ {
+		m.writers.Add(1)
+		go m.write()
+	}
+
+	sink := input.Sink{Metrics: m.metricsIn, Events: m.eventsIn, ServiceChecks: m.serviceChecksIn}
+
+	for _, listener := range configuration.Inputs {
+		err := listener.Start(context.Background(), sink)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 
-	configuration = config.ParseConfig(configFile, m.metricsIn, m.eventsIn)
 	log.Print("Begining aggregation")
-	m.aggregate()
+	m.aggregate(signals)
+
+	if !m.shutdown() {
+		os.Exit(1)
+	}
+	log.Print("Stopped aggregateD")
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ccpgames/aggregateD/config"
+	"github.com/ccpgames/aggregateD/input"
+	"github.com/ccpgames/aggregateD/output"
+)
+
+//recordingWriter is an output which keeps every bucket written to it
+type recordingWriter struct {
+	lock    sync.Mutex
+	buckets []output.Bucket
+}
+
+func (w *recordingWriter) Name() string {
+	return "recording"
+}
+
+func (w *recordingWriter) Write(buckets []output.Bucket) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.buckets = append(w.buckets, buckets...)
+	return nil
+}
+
+func (w *recordingWriter) Close() error {
+	return nil
+}
+
+//startTestMain starts a Main the way main does, writing to writer and
+//replaying a Redis fallback which is never due to be checked
+func startTestMain(writer output.Writer) *Main {
+	configuration = config.Configuration{
+		FlushInterval:         3600,
+		AggregationInterval:   10,
+		AggregationShards:     2,
+		OutputQueueDepth:      4,
+		OutputQueueDropPolicy: output.DropOldest,
+		OutputWriters:         1,
+		ShutdownTimeout:       5,
+		Outputs:               []output.Writer{writer},
+		RedisReplays:          []config.RedisReplay{{}},
+	}
+
+	m := newMain()
+	m.startReplays()
+	m.flushes = output.NewQueue(configuration.OutputQueueDepth, configuration.OutputQueueDropPolicy)
+
+	for i := 0; i < configuration.AggregationShards; i++ {
+		s := newShard()
+		m.shards = append(m.shards, s)
+		go s.run()
+	}
+
+	m.writers.Add(1)
+	go m.write()
+	return m
+}
+
+//expectShutdown checks that m shuts down well within the shutdown timeout
+//and writes requests in its final flush
+func expectShutdown(t *testing.T, m *Main, writer *recordingWriter) {
+	m.metricsIn <- input.Metric{Name: "requests", Type: "counter", Value: 1, Sampling: 1, Timestamp: 1461204545, Aggregate: true}
+
+	started := time.Now()
+	if !m.shutdown() {
+		t.Fatal("Expected the final flush to be written")
+	}
+
+	if time.Since(started) > time.Second {
+		t.Error("Expected shutdown not to wait for the shutdown timeout, took", time.Since(started))
+	}
+
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+
+	for _, bucket := range writer.buckets {
+		if bucket.Name == "requests" {
+			return
+		}
+	}
+	t.Error("Expected the final flush to include requests got", writer.buckets)
+}
+
+func TestShutdownBeforeFlush(t *testing.T) {
+	writer := new(recordingWriter)
+	expectShutdown(t, startTestMain(writer), writer)
+}
+
+func TestShutdownAfterFlush(t *testing.T) {
+	writer := new(recordingWriter)
+	m := startTestMain(writer)
+
+	m.flush(int(time.Now().Unix()))
+	expectShutdown(t, m, writer)
+}
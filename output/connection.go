@@ -0,0 +1,120 @@
+package output
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+//ConnectionConfig describes the connections an output keeps open to its
+//server for the life of the process
+type ConnectionConfig struct {
+	//Timeout is the longest a single request may take, zero is unlimited
+	Timeout time.Duration
+	//DialTimeout is the longest connecting, including the TLS handshake, may take
+	DialTimeout time.Duration
+	//KeepAlive is the interval between TCP keepalive probes, they find
+	//connections which have been broken without being closed
+	KeepAlive time.Duration
+	//IdleTimeout is how long an unused connection is kept open
+	IdleTimeout time.Duration
+	//TLS is nil unless the output has TLS settings
+	TLS *tls.Config
+}
+
+//NewConnectionConfig reads the connection settings of an output, i.e.
+//timeout: 30
+//dialTimeout: 5
+//keepAlive: 30
+//idleTimeout: 90
+//tls:
+//  caFile: /etc/ssl/certs/ca.pem
+//times are in seconds
+func NewConnectionConfig(name string, settings Settings) (ConnectionConfig, error) {
+	var config ConnectionConfig
+	seconds := map[string]*time.Duration{
+		"timeout":     &config.Timeout,
+		"dialTimeout": &config.DialTimeout,
+		"keepAlive":   &config.KeepAlive,
+		"idleTimeout": &config.IdleTimeout,
+	}
+	defaults := map[string]int64{"timeout": 30, "dialTimeout": 5, "keepAlive": 30, "idleTimeout": 90}
+
+	for key, duration := range seconds {
+		value, err := settings.Int(key, defaults[key])
+		if err != nil {
+			return config, fmt.Errorf("output %s: %s", name, err)
+		}
+
+		if value < 0 {
+			return config, fmt.Errorf("output %s: %s must not be negative", name, key)
+		}
+		*duration = time.Duration(value) * time.Second
+	}
+
+	tlsSettings, err := settings.Section("tls")
+	if err != nil {
+		return config, fmt.Errorf("output %s: %s", name, err)
+	}
+
+	if tlsSettings != nil {
+		if config.TLS, err = newTLSConfig(tlsSettings); err != nil {
+			return config, fmt.Errorf("output %s: %s", name, err)
+		}
+	}
+
+	return config, nil
+}
+
+//newTLSConfig reads the tls settings of an output, the CA file replaces the
+//system roots and a client certificate is only presented if both its
+//certificate and key files are given
+func newTLSConfig(settings Settings) (*tls.Config, error) {
+	insecureSkipVerify, err := settings.Bool("insecureSkipVerify", false)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		ServerName:         settings.String("serverName", ""),
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+
+	if caFile := settings.String("caFile", ""); caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+
+	certFile := settings.String("certFile", "")
+	keyFile := settings.String("keyFile", "")
+
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("certFile and keyFile must be given together")
+	}
+
+	if certFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
+
+//dialer returns a dialer for new connections with the dial timeout and
+//keepalive interval of config
+func (config ConnectionConfig) dialer() *net.Dialer {
+	return &net.Dialer{Timeout: config.DialTimeout, KeepAlive: config.KeepAlive}
+}
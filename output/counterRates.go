@@ -0,0 +1,65 @@
+package output
+
+const (
+	//CounterRateWindow calculates the rate of a counter over the aggregation
+	//window of its bucket
+	CounterRateWindow = "window"
+	//CounterRateFlush calculates the rate of a counter over the flush interval
+	CounterRateFlush = "flush"
+	//CounterRateNone disables counter rates
+	CounterRateNone = "none"
+)
+
+//WithCounterRates returns the buckets with a per second rate field added to
+//each counter alongside its total. Outputs may calculate rates differently,
+//so counters are copied rather than modified, other buckets are shared.
+func WithCounterRates(buckets []Bucket, counterRate string, flushInterval int) []Bucket {
+	if counterRate == CounterRateNone || counterRate == "" {
+		return buckets
+	}
+
+	ratedBuckets := make([]Bucket, len(buckets))
+
+	for i, bucket := range buckets {
+		ratedBuckets[i] = bucket
+		value, ok := bucket.Fields["value"].(float64)
+
+		if bucket.Type != "counter" || !ok {
+			continue
+		}
+
+		seconds := bucket.Interval
+		if counterRate == CounterRateFlush {
+			seconds = flushInterval
+		}
+
+		if seconds <= 0 {
+			continue
+		}
+
+		ratedBuckets[i].Fields = make(map[string]interface{}, len(bucket.Fields)+1)
+		for k, v := range bucket.Fields {
+			ratedBuckets[i].Fields[k] = v
+		}
+		ratedBuckets[i].Fields["rate"] = value / float64(seconds)
+	}
+
+	return ratedBuckets
+}
+
+//ratedWriter adds counter rates to buckets before writing them to an output
+type ratedWriter struct {
+	Writer
+	counterRate   string
+	flushInterval int
+}
+
+//WithCounterRateWriter returns an output which adds counter rates, see
+//WithCounterRates, to every bucket written to it
+func WithCounterRateWriter(writer Writer, counterRate string, flushInterval int) Writer {
+	return &ratedWriter{Writer: writer, counterRate: counterRate, flushInterval: flushInterval}
+}
+
+func (w *ratedWriter) Write(buckets []Bucket) error {
+	return w.Writer.Write(WithCounterRates(buckets, w.counterRate, w.flushInterval))
+}
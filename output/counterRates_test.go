@@ -0,0 +1,36 @@
+package output
+
+import "testing"
+
+func TestWithCounterRates(t *testing.T) {
+	buckets := []Bucket{
+		{Name: "requests", Type: "counter", Interval: 10, Fields: map[string]interface{}{"value": 50.0}},
+		{Name: "connections", Type: "gauge", Interval: 10, Fields: map[string]interface{}{"value": 50.0}},
+	}
+
+	rated := WithCounterRates(buckets, CounterRateWindow, 60)
+
+	if rated[0].Fields["rate"] != 5.0 {
+		t.Error("Expected a rate of 5 over the window got", rated[0].Fields["rate"])
+	}
+
+	if _, ok := rated[1].Fields["rate"]; ok {
+		t.Error("Expected gauges not to have a rate")
+	}
+
+	if _, ok := buckets[0].Fields["rate"]; ok {
+		t.Error("Expected the original bucket not to be modified")
+	}
+
+	rated = WithCounterRates(buckets, CounterRateFlush, 25)
+
+	if rated[0].Fields["rate"] != 2.0 {
+		t.Error("Expected a rate of 2 over the flush interval got", rated[0].Fields["rate"])
+	}
+
+	rated = WithCounterRates(buckets, CounterRateNone, 25)
+
+	if _, ok := rated[0].Fields["rate"]; ok {
+		t.Error("Expected no rate when rates are disabled")
+	}
+}
@@ -1,12 +1,26 @@
 package output
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/ccpgames/aggregateD/sketch"
 	"github.com/influxdata/influxdb/client/v2"
 )
 
+//influxDBWrittenChunks and influxDBFailedChunks count chunks written by
+//every InfluxDB output, they are updated atomically
+var influxDBWrittenChunks, influxDBFailedChunks uint64
+
 type (
 	//InfluxDBConfig describes the configuration details for Influx connection
 	InfluxDBConfig struct {
@@ -14,6 +28,39 @@ type (
 		InfluxUsername  string
 		InfluxPassword  string
 		InfluxDefaultDB string
+		//a flush is written in chunks of at most MaxBatchPoints points and
+		//MaxBatchBytes bytes of line protocol, zero is unlimited. Up to
+		//Parallelism chunks are written at once
+		MaxBatchPoints int
+		MaxBatchBytes  int
+		Parallelism    int
+		//Connection describes the connections kept open to InfluxDB
+		Connection ConnectionConfig
+	}
+
+	//PartialWriteError is returned when some chunks of a write failed,
+	//Failed holds the buckets of the failed chunks so that only they are
+	//retried, written to a fallback or spooled
+	PartialWriteError struct {
+		Failed []Bucket
+		//Errors holds the error of each failed chunk
+		Errors []error
+		Chunks int
+	}
+
+	//influxDBChunk is a part of a write, along with the buckets its points
+	//were made from
+	influxDBChunk struct {
+		points  []*client.Point
+		buckets []Bucket
+	}
+
+	//InfluxDBWriter is an output which writes buckets to InfluxDB, its
+	//client keeps connections open between writes
+	InfluxDBWriter struct {
+		name   string
+		config InfluxDBConfig
+		client *http.Client
 	}
 
 	//Bucket is a struct representing an aggregated series of metrics.
@@ -23,34 +70,193 @@ type (
 		Name      string            `json:"name"`
 		Timestamp time.Time         `json:"timestamp"`
 		Tags      map[string]string `json:"tags"`
-		//intermediate values for histograms, only fields are sent to influxdb
-		Values []float64              `json:"-"`
+		//the metric type and the number of seconds the bucket spans,
+		//these are only set for aggregated metrics
+		Type     string `json:"-"`
+		Interval int    `json:"-"`
+		//intermediate values for timers, only fields are sent to influxdb
+		Values []float64 `json:"-"`
+		//intermediate summary of histograms and distributions
+		Sketch *sketch.DDSketch `json:"-"`
+		//intermediate members of sets
+		Set    *sketch.Set            `json:"-"`
 		Fields map[string]interface{} `json:"fields"`
 	}
 )
 
-//WriteToInfluxDB takes a map of bucket slices, indexed by database and writes
-//each of those slices to InfluxDB as batch points
-func WriteToInfluxDB(buckets []Bucket, config InfluxDBConfig) error {
-	c, clientErr := client.NewHTTPClient(client.HTTPConfig{
-		Addr:     config.InfluxURL,
-		Username: config.InfluxUsername,
-		Password: config.InfluxPassword,
+func init() {
+	Register("influxdb", func(name string, settings Settings) (Writer, error) {
+		config, err := NewInfluxDBConfig(name, settings)
+		if err != nil {
+			return nil, err
+		}
+		return &InfluxDBWriter{name: name, config: config, client: NewInfluxDBClient(config)}, nil
 	})
+}
+
+//NewInfluxDBConfig reads the connection details of an InfluxDB output
+func NewInfluxDBConfig(name string, settings Settings) (InfluxDBConfig, error) {
+	var config InfluxDBConfig
+	var err error
 
-	if clientErr != nil {
-		return clientErr
+	if config.InfluxURL, err = settings.require(name, "url"); err != nil {
+		return config, err
+	}
+	if influxURL, err := url.Parse(config.InfluxURL); err != nil || influxURL.Scheme != "http" && influxURL.Scheme != "https" {
+		return config, fmt.Errorf("output %s: url must start with http:// or https://", name)
+	}
+	if config.InfluxUsername, err = settings.require(name, "username"); err != nil {
+		return config, err
+	}
+	if config.InfluxPassword, err = settings.require(name, "password"); err != nil {
+		return config, err
+	}
+	if config.InfluxDefaultDB, err = settings.require(name, "database"); err != nil {
+		return config, err
 	}
 
-	points, pointErr := client.NewBatchPoints(client.BatchPointsConfig{
-		Database:  config.InfluxDefaultDB,
-		Precision: "s",
-	})
+	//InfluxDB rejects requests over 25MB by default
+	maxBatchPoints, err := settings.Int("maxBatchPoints", 5000)
+	if err != nil {
+		return config, err
+	}
+
+	maxBatchBytes, err := settings.Int("maxBatchBytes", 10*1024*1024)
+	if err != nil {
+		return config, err
+	}
+
+	parallelism, err := settings.Int("parallelism", 4)
+	if err != nil {
+		return config, err
+	}
+
+	if maxBatchPoints < 0 || maxBatchBytes < 0 || parallelism < 1 {
+		return config, fmt.Errorf("output %s: batch limits must not be negative and parallelism must be at least 1", name)
+	}
+
+	config.MaxBatchPoints = int(maxBatchPoints)
+	config.MaxBatchBytes = int(maxBatchBytes)
+	config.Parallelism = int(parallelism)
+
+	config.Connection, err = NewConnectionConfig(name, settings)
+	return config, err
+}
+
+//NewInfluxDBClient returns an HTTP client for the InfluxDB of config, idle
+//connections are kept open for reuse by later requests. The InfluxDB client
+//library makes its own transport, so its keepalives and idle connections
+//cannot be configured and it is only used to encode points
+func NewInfluxDBClient(config InfluxDBConfig) *http.Client {
+	connection := config.Connection
+
+	return &http.Client{
+		Timeout: connection.Timeout,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         connection.dialer().DialContext,
+			TLSClientConfig:     connection.TLS,
+			TLSHandshakeTimeout: connection.DialTimeout,
+			IdleConnTimeout:     connection.IdleTimeout,
+			//every chunk being written at once can reuse a connection
+			MaxIdleConnsPerHost: config.Parallelism,
+		},
+	}
+}
+
+//Name returns the name of the output
+func (w *InfluxDBWriter) Name() string {
+	return w.name
+}
+
+//Write writes buckets to InfluxDB with the connections of the output, see
+//WriteToInfluxDB
+func (w *InfluxDBWriter) Write(buckets []Bucket) error {
+	return writeInfluxDB(w.client, buckets, w.config)
+}
+
+//Close closes the idle connections of the output
+func (w *InfluxDBWriter) Close() error {
+	w.client.CloseIdleConnections()
+	return nil
+}
+
+//WriteToInfluxDB writes buckets to InfluxDB as batch points, split into
+//chunks by the batch limits of config. If only some chunks fail a
+//*PartialWriteError is returned. Its connections are closed once the
+//write is complete, outputs instead keep theirs open
+func WriteToInfluxDB(buckets []Bucket, config InfluxDBConfig) error {
+	c := NewInfluxDBClient(config)
+	defer c.CloseIdleConnections()
+
+	return writeInfluxDB(c, buckets, config)
+}
+
+func writeInfluxDB(c *http.Client, buckets []Bucket, config InfluxDBConfig) error {
+	chunks := chunkPoints(buckets, config)
+	errs := make([]error, len(chunks))
+	written := 0
+
+	for _, chunk := range chunks {
+		written += len(chunk.points)
+	}
+	log.Printf("Writing %d points to InfluxDB in %d chunks", written, len(chunks))
 
-	if pointErr != nil {
-		return pointErr
+	parallelism := config.Parallelism
+	if parallelism < 1 {
+		parallelism = 1
 	}
 
+	//chunks are written concurrently, at most parallelism at a time
+	slots := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+
+	for i := range chunks {
+		wg.Add(1)
+		slots <- struct{}{}
+
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			errs[i] = writeInfluxDBChunk(c, chunks[i], config)
+		}(i)
+	}
+	wg.Wait()
+
+	partial := new(PartialWriteError)
+	partial.Chunks = len(chunks)
+
+	for i, err := range errs {
+		if err != nil {
+			atomic.AddUint64(&influxDBFailedChunks, 1)
+			log.Printf("Chunk %d of %d failed: %s", i+1, len(chunks), err)
+			partial.Failed = append(partial.Failed, chunks[i].buckets...)
+			partial.Errors = append(partial.Errors, err)
+		} else {
+			atomic.AddUint64(&influxDBWrittenChunks, 1)
+		}
+	}
+
+	if len(partial.Errors) == 0 {
+		return nil
+	}
+
+	//a write which failed entirely is reported as the error itself
+	if len(partial.Errors) == len(chunks) {
+		return partial.Errors[0]
+	}
+
+	return partial
+}
+
+//chunkPoints converts buckets to points, split into chunks of at most
+//MaxBatchPoints points and MaxBatchBytes bytes. Malformed points are excluded
+func chunkPoints(buckets []Bucket, config InfluxDBConfig) []influxDBChunk {
+	var chunks []influxDBChunk
+	var current influxDBChunk
+	currentBytes := 0
+
 	for k := range buckets {
 		bucket := buckets[k]
 
@@ -62,18 +268,93 @@ func WriteToInfluxDB(buckets []Bucket, config InfluxDBConfig) error {
 
 		if err != nil {
 			log.Printf("Malformed point, {%s, %s, %s %s} excluded from batch", bucket.Name, bucket.Tags, bucket.Fields, bucket.Timestamp)
-		} else {
-			points.AddPoint(point)
+			continue
 		}
+
+		//each point is a line of the request body
+		size := len(point.PrecisionString("s")) + 1
+		full := config.MaxBatchPoints > 0 && len(current.points) >= config.MaxBatchPoints
+		full = full || config.MaxBatchBytes > 0 && currentBytes+size > config.MaxBatchBytes
+
+		if full && len(current.points) > 0 {
+			chunks = append(chunks, current)
+			current = influxDBChunk{}
+			currentBytes = 0
+		}
+
+		current.points = append(current.points, point)
+		current.buckets = append(current.buckets, bucket)
+		currentBytes += size
 	}
-	log.Printf("Writing %d points to InfluxDB", len(points.Points()))
 
-	writeError := c.Write(points)
+	if len(current.points) > 0 {
+		chunks = append(chunks, current)
+	}
+
+	return chunks
+}
+
+//writeInfluxDBChunk writes a chunk as line protocol, in the same way as the
+//InfluxDB client
+func writeInfluxDBChunk(c *http.Client, chunk influxDBChunk, config InfluxDBConfig) error {
+	writeURL, err := url.Parse(config.InfluxURL)
+	if err != nil {
+		return err
+	}
+
+	writeURL.Path = path.Join(writeURL.Path, "write")
+	writeURL.RawQuery = url.Values{"db": {config.InfluxDefaultDB}, "precision": {"s"}}.Encode()
+
+	var body bytes.Buffer
+	for _, point := range chunk.points {
+		body.WriteString(point.PrecisionString("s"))
+		body.WriteByte('\n')
+	}
+
+	request, err := http.NewRequest("POST", writeURL.String(), &body)
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("User-Agent", "aggregateD")
+	if config.InfluxUsername != "" {
+		request.SetBasicAuth(config.InfluxUsername, config.InfluxPassword)
+	}
+
+	response, err := c.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
 
-	if writeError != nil {
-		log.Println(writeError)
-		return writeError
+	//the response is read in full, otherwise its connection is not reused
+	message, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
 	}
 
+	if response.StatusCode != http.StatusNoContent && response.StatusCode != http.StatusOK {
+		return fmt.Errorf("InfluxDB responded %s: %s", response.Status, strings.TrimSpace(string(message)))
+	}
 	return nil
 }
+
+func (err *PartialWriteError) Error() string {
+	return fmt.Sprintf("%d of %d chunks failed, the first error was: %s", len(err.Errors), err.Chunks, err.Errors[0])
+}
+
+//FailedBuckets returns the buckets of a write which failed with err, for a
+//*PartialWriteError these are the buckets of the failed chunks, otherwise
+//every bucket failed
+func FailedBuckets(buckets []Bucket, err error) []Bucket {
+	if partial, ok := err.(*PartialWriteError); ok {
+		return partial.Failed
+	}
+	return buckets
+}
+
+//InfluxDBChunks returns the number of chunks which have been written to
+//InfluxDB and the number which failed
+func InfluxDBChunks() (written uint64, failed uint64) {
+	return atomic.LoadUint64(&influxDBWrittenChunks), atomic.LoadUint64(&influxDBFailedChunks)
+}
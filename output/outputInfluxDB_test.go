@@ -0,0 +1,127 @@
+package output
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestBuckets(names ...string) []Bucket {
+	var buckets []Bucket
+
+	for _, name := range names {
+		buckets = append(buckets, Bucket{Name: name, Timestamp: time.Unix(1461204540, 0), Fields: map[string]interface{}{"value": 1.0}})
+	}
+	return buckets
+}
+
+func TestChunkPoints(t *testing.T) {
+	buckets := newTestBuckets("a", "b", "c", "d", "e")
+
+	chunks := chunkPoints(buckets, InfluxDBConfig{MaxBatchPoints: 2})
+	if len(chunks) != 3 || len(chunks[2].buckets) != 1 {
+		t.Error("Expected chunks of at most 2 points got", len(chunks))
+	}
+
+	//each point is "a value=1 1461204540\n", 21 bytes
+	chunks = chunkPoints(buckets, InfluxDBConfig{MaxBatchBytes: 50})
+	if len(chunks) != 3 || len(chunks[0].points) != 2 {
+		t.Error("Expected chunks of at most 50 bytes got", len(chunks))
+	}
+
+	chunks = chunkPoints(buckets, InfluxDBConfig{})
+	if len(chunks) != 1 {
+		t.Error("Expected a single chunk without limits got", len(chunks))
+	}
+}
+
+func TestPartialWrite(t *testing.T) {
+	influxDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		if strings.Contains(string(body), "bad") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer influxDB.Close()
+
+	config := InfluxDBConfig{InfluxURL: influxDB.URL, InfluxDefaultDB: "metrics", MaxBatchPoints: 2, Parallelism: 2}
+	buckets := newTestBuckets("a", "b", "bad", "c", "d")
+
+	err := WriteToInfluxDB(buckets, config)
+	partial, ok := err.(*PartialWriteError)
+
+	if !ok {
+		t.Fatal("Expected a partial write error got", err)
+	}
+
+	failed := FailedBuckets(buckets, err)
+	if partial.Chunks != 3 || len(failed) != 2 || failed[0].Name != "bad" || failed[1].Name != "c" {
+		t.Error("Expected only the chunk with the failed point to fail got", failed)
+	}
+
+	if err := WriteToInfluxDB(newTestBuckets("a", "b", "c"), config); err != nil {
+		t.Error("Expected every chunk to be written got", err)
+	}
+}
+
+func TestInfluxDBWriterReusesConnections(t *testing.T) {
+	var connections int32
+	influxDB := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	influxDB.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	influxDB.Start()
+	defer influxDB.Close()
+
+	writer, err := New("influxdb", "influxdb", Settings{"url": influxDB.URL, "username": "aggregated", "password": "secret", "database": "metrics"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := writer.Write(newTestBuckets("a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if atomic.LoadInt32(&connections) != 1 {
+		t.Error("Expected every write to use the same connection got", connections)
+	}
+}
+
+func TestConnectionConfig(t *testing.T) {
+	config, err := NewConnectionConfig("influxdb", Settings{"timeout": 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Timeout != 10*time.Second || config.DialTimeout != 5*time.Second || config.TLS != nil {
+		t.Error("Expected a 10 second timeout, defaults and no TLS got", config)
+	}
+
+	config, err = NewConnectionConfig("influxdb", Settings{"tls": map[string]interface{}{"serverName": "influxdb.example.com", "insecureSkipVerify": "true"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.TLS == nil || config.TLS.ServerName != "influxdb.example.com" || !config.TLS.InsecureSkipVerify {
+		t.Error("Expected TLS settings got", config.TLS)
+	}
+
+	if _, err := NewConnectionConfig("influxdb", Settings{"tls": map[string]interface{}{"certFile": "client.pem"}}); err == nil {
+		t.Error("Expected an error for a certificate without a key")
+	}
+}
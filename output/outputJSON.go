@@ -1,28 +1,101 @@
 package output
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
-	"strings"
 )
 
-//WriteJSON POSTs the json encoded bucket to the defined URL
+//JSONWriter is an output which PUTs each bucket to a URL as JSON
+type JSONWriter struct {
+	name      string
+	outputURL url.URL
+}
+
+func init() {
+	Register("json", func(name string, settings Settings) (Writer, error) {
+		rawURL, err := settings.require(name, "url")
+		if err != nil {
+			return nil, err
+		}
+
+		outputURL, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		return &JSONWriter{name: name, outputURL: *outputURL}, nil
+	})
+}
+
+//Name returns the name of the output
+func (w *JSONWriter) Name() string {
+	return w.name
+}
+
+//Write writes buckets to the URL, see WriteJSON
+func (w *JSONWriter) Write(buckets []Bucket) error {
+	return WriteJSON(buckets, w.outputURL)
+}
+
+//Close releases the output, there is nothing to release
+func (w *JSONWriter) Close() error {
+	return nil
+}
+
+//WriteJSON PUTs each json encoded bucket to the defined URL
 //This is mostly intended to be used for diaganostic output but
-//can also be used to forward metrics to other services, it is
-//configured by setting outputJSON to true and outputURL to a
-//valid URL in the configuration file
-func WriteJSON(buckets []Bucket, outputURL url.URL) {
+//can also be used to forward metrics to other services. If only some
+//buckets could not be written a *PartialWriteError holding them is returned,
+//each bucket is a chunk of its own
+func WriteJSON(buckets []Bucket, outputURL url.URL) error {
+	partial := new(PartialWriteError)
+	partial.Chunks = len(buckets)
+
 	for i := range buckets {
-		jsonStr, _ := json.Marshal(buckets[i])
-		client := &http.Client{}
-		request, _ := http.NewRequest("PUT", outputURL.String(), strings.NewReader(string(jsonStr)))
-		request.Header.Set("Content-Type", "application/json")
-		response, err := client.Do(request)
-
-		if err == nil {
-			defer response.Body.Close()
-		} else {
+		if err := putJSONBucket(buckets[i], outputURL); err != nil {
+			partial.Failed = append(partial.Failed, buckets[i])
+			partial.Errors = append(partial.Errors, err)
 		}
 	}
+
+	if len(partial.Errors) == 0 {
+		return nil
+	}
+
+	if len(partial.Errors) == len(buckets) {
+		return partial.Errors[0]
+	}
+
+	return partial
+}
+
+func putJSONBucket(bucket Bucket, outputURL url.URL) error {
+	jsonStr, err := json.Marshal(bucket)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest("PUT", outputURL.String(), bytes.NewReader(jsonStr))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	//the response is read in full so that its connection is reused
+	io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("%s responded %s", outputURL.String(), response.Status)
+	}
+	return nil
 }
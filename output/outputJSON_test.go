@@ -0,0 +1,41 @@
+package output
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestJSONWriteErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var bucket Bucket
+		json.NewDecoder(r.Body).Decode(&bucket)
+
+		if bucket.Name == "bad" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	writer := &JSONWriter{name: "json", outputURL: *serverURL}
+
+	if err := writer.Write(newTestBuckets("a", "b")); err != nil {
+		t.Error("Expected every bucket to be written got", err)
+	}
+
+	buckets := newTestBuckets("a", "bad", "b")
+	failed := FailedBuckets(buckets, writer.Write(buckets))
+
+	if len(failed) != 1 || failed[0].Name != "bad" {
+		t.Error("Expected only the rejected bucket to fail got", failed)
+	}
+
+	//an unreachable URL fails the whole write, so that the fallback is used
+	server.Close()
+	if err := writer.Write(newTestBuckets("a")); err == nil {
+		t.Error("Expected an error for an unreachable URL")
+	}
+}
@@ -1,30 +1,304 @@
 package output
 
 import (
+	"bytes"
+	"crypto/tls"
 	"encoding/json"
+	"fmt"
+	"log"
+	"net"
 	"net/url"
+	"sync"
+
+	"github.com/mediocregopher/radix.v2/pool"
+	"github.com/mediocregopher/radix.v2/redis"
 )
-import "github.com/mediocregopher/radix.v2/redis"
+
+type (
+	//RedisWriter is an output which pushes buckets onto a Redis list, it is
+	//usually the fallback of an InfluxDB output. Connections are pooled for
+	//the life of the output, broken connections are discarded by the pool
+	//and replaced by new ones
+	RedisWriter struct {
+		name     string
+		redisURL url.URL
+		//key is the list buckets are pushed to, replayBatchSize is the most
+		//buckets read from it at once when replaying
+		key             string
+		replayBatchSize int
+		poolSize        int
+		connection      ConnectionConfig
+		//pool is opened by the first write, so that aggregateD starts
+		//while Redis is unavailable
+		pool     *pool.Pool
+		poolLock sync.Mutex
+	}
+
+	//redisBucket is a bucket as it is pushed to Redis. JSON does not
+	//distinguish whole floats from integers, so integer fields are listed in
+	//order that they have the same type in InfluxDB when replayed. The type
+	//and interval are kept so that counter rates can be added when replayed
+	redisBucket struct {
+		Bucket
+		Type     string   `json:"type,omitempty"`
+		Interval int      `json:"interval,omitempty"`
+		Integers []string `json:"integers,omitempty"`
+	}
+)
+
+func init() {
+	Register("redis", func(name string, settings Settings) (Writer, error) {
+		rawURL, err := settings.require(name, "url")
+		if err != nil {
+			return nil, err
+		}
+
+		redisURL, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, err
+		}
+
+		replayBatchSize, err := settings.Int("replayBatchSize", 1000)
+		if err != nil {
+			return nil, err
+		}
+
+		poolSize, err := settings.Int("poolSize", 4)
+		if err != nil {
+			return nil, err
+		}
+
+		if replayBatchSize < 1 {
+			return nil, fmt.Errorf("output %s: replayBatchSize must be at least 1", name)
+		}
+
+		if poolSize < 0 {
+			return nil, fmt.Errorf("output %s: poolSize must not be negative", name)
+		}
+
+		connection, err := NewConnectionConfig(name, settings)
+		if err != nil {
+			return nil, err
+		}
+
+		return &RedisWriter{
+			name:            name,
+			redisURL:        *redisURL,
+			key:             settings.String("key", "aggregated"),
+			replayBatchSize: int(replayBatchSize),
+			poolSize:        int(poolSize),
+			connection:      connection,
+		}, nil
+	})
+}
+
+//Name returns the name of the output
+func (w *RedisWriter) Name() string {
+	return w.name
+}
+
+//Write writes buckets to Redis with a pooled connection, see WriteRedis
+func (w *RedisWriter) Write(buckets []Bucket) error {
+	connections, err := w.connections()
+	if err != nil {
+		return err
+	}
+
+	return pushRedisBuckets(connections.Cmd, buckets, w.key)
+}
+
+//Close closes the pooled connections of the output
+func (w *RedisWriter) Close() error {
+	w.poolLock.Lock()
+	defer w.poolLock.Unlock()
+
+	if w.pool != nil {
+		w.pool.Empty()
+		w.pool = nil
+	}
+	return nil
+}
+
+//connections returns the connection pool of the output, opening it if need
+//be. If Redis cannot be reached the pool is still kept, it connects again
+//when a connection is next needed
+func (w *RedisWriter) connections() (*pool.Pool, error) {
+	w.poolLock.Lock()
+	defer w.poolLock.Unlock()
+
+	if w.pool != nil {
+		return w.pool, nil
+	}
+
+	connections, err := pool.NewCustom("tcp", w.redisURL.String(), w.poolSize, w.dial)
+	w.pool = connections
+	return connections, err
+}
+
+//dial makes a connection to Redis with the connection settings of the output
+func (w *RedisWriter) dial(network string, addr string) (*redis.Client, error) {
+	dialer := w.connection.dialer()
+	var conn net.Conn
+	var err error
+
+	if w.connection.TLS != nil {
+		conn, err = tls.DialWithDialer(dialer, network, addr, w.connection.TLS)
+	} else {
+		conn, err = dialer.Dial(network, addr)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	redisClient, err := redis.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	redisClient.ReadTimeout = w.connection.Timeout
+	redisClient.WriteTimeout = w.connection.Timeout
+	return redisClient, nil
+}
+
+//Replay writes the buckets in the Redis list with write, oldest first and in
+//batches of up to replayBatchSize buckets, until the list is empty. Buckets
+//are only removed from the list once they have been written, so a batch may
+//be written twice if aggregateD stops between writing and removing it.
+//Returns the number of buckets replayed
+func (w *RedisWriter) Replay(write func([]Bucket) error) (int, error) {
+	connections, err := w.connections()
+	if err != nil {
+		return 0, err
+	}
+
+	redisClient, err := connections.Get()
+	if err != nil {
+		return 0, err
+	}
+	defer connections.Put(redisClient)
+
+	replayed := 0
+
+	for {
+		items, err := redisClient.Cmd("LRANGE", w.key, 0, w.replayBatchSize-1).List()
+
+		if err != nil || len(items) == 0 {
+			return replayed, err
+		}
+
+		batch := make([]Bucket, 0, len(items))
+		for _, item := range items {
+			bucket, err := decodeRedisBucket([]byte(item))
+
+			if err != nil {
+				log.Printf("Dropping malformed bucket %q from Redis: %s", item, err)
+				continue
+			}
+			batch = append(batch, bucket)
+		}
+
+		if len(batch) > 0 {
+			if err := write(batch); err != nil {
+				return replayed, err
+			}
+		}
+
+		if err := redisClient.Cmd("LTRIM", w.key, len(items), -1).Err; err != nil {
+			return replayed, err
+		}
+
+		replayed += len(batch)
+	}
+}
 
 //WriteRedis writes buckets to a Redis list. Buckets are encoded
 //as JSON. Returns err if a write fails.
 func WriteRedis(buckets []Bucket, redisURL url.URL) error {
+	return writeRedisList(buckets, redisURL, "aggregated")
+}
+
+func writeRedisList(buckets []Bucket, redisURL url.URL, key string) error {
 	redisClient, redisErr := redis.Dial("tcp", redisURL.String())
 	if redisErr != nil {
 		return redisErr
 	}
+	defer redisClient.Close()
+
+	return pushRedisBuckets(redisClient.Cmd, buckets, key)
+}
 
-	for bucket := range buckets {
-		jsonBucket, jsonErr := json.Marshal(bucket)
+//pushRedisBuckets pushes buckets onto a Redis list with a single RPUSH, so
+//that a write which fails part way through does not leave some of its
+//buckets in the list
+func pushRedisBuckets(cmd func(string, ...interface{}) *redis.Resp, buckets []Bucket, key string) error {
+	values := make([]interface{}, 0, len(buckets))
+
+	for _, bucket := range buckets {
+		jsonBucket, jsonErr := encodeRedisBucket(bucket)
 
 		if jsonErr == nil {
-			resp := redisClient.Cmd("RPUSH", "aggregated", jsonBucket)
-			if resp.Err != nil {
-				return resp.Err
-			}
+			values = append(values, jsonBucket)
 		}
 	}
 
-	return nil
+	if len(values) == 0 {
+		return nil
+	}
+
+	return cmd("RPUSH", key, values).Err
+}
+
+func encodeRedisBucket(bucket Bucket) ([]byte, error) {
+	encoded := redisBucket{Bucket: bucket, Type: bucket.Type, Interval: bucket.Interval}
+
+	for k, v := range bucket.Fields {
+		switch v.(type) {
+		case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+			encoded.Integers = append(encoded.Integers, k)
+		}
+	}
+
+	return json.Marshal(encoded)
+}
+
+func decodeRedisBucket(data []byte) (Bucket, error) {
+	var decoded redisBucket
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&decoded); err != nil {
+		return Bucket{}, err
+	}
+
+	decoded.Bucket.Type = decoded.Type
+	decoded.Bucket.Interval = decoded.Interval
+
+	integers := make(map[string]bool, len(decoded.Integers))
+	for _, k := range decoded.Integers {
+		integers[k] = true
+	}
+
+	for k, v := range decoded.Fields {
+		number, ok := v.(json.Number)
+
+		if !ok {
+			continue
+		}
+
+		var err error
+		if integers[k] {
+			decoded.Fields[k], err = number.Int64()
+		} else {
+			decoded.Fields[k], err = number.Float64()
+		}
+
+		if err != nil {
+			return Bucket{}, err
+		}
+	}
 
+	return decoded.Bucket, nil
 }
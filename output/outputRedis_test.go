@@ -0,0 +1,288 @@
+package output
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRedisBucketEncoding(t *testing.T) {
+	bucket := Bucket{
+		Name:      "requests",
+		Timestamp: time.Unix(1461204540, 0),
+		Tags:      map[string]string{"host": "web1"},
+		Type:      "counter",
+		Interval:  10,
+		Fields:    map[string]interface{}{"value": 3.0, "count": int64(3), "host": "web1"},
+	}
+
+	encoded, err := encodeRedisBucket(bucket)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := decodeRedisBucket(encoded)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Name != "requests" || !decoded.Timestamp.Equal(bucket.Timestamp) || decoded.Tags["host"] != "web1" {
+		t.Error("Expected the bucket to be decoded with its original timestamp got", decoded)
+	}
+
+	if decoded.Fields["value"] != 3.0 || decoded.Fields["count"] != int64(3) || decoded.Fields["host"] != "web1" {
+		t.Errorf("Expected fields to keep their types got %#v", decoded.Fields)
+	}
+
+	//counter rates are added when the bucket is replayed
+	if decoded.Type != "counter" || decoded.Interval != 10 {
+		t.Error("Expected the type and interval to be kept got", decoded.Type, decoded.Interval)
+	}
+
+	//buckets pushed by earlier versions were the index of the bucket
+	if _, err := decodeRedisBucket([]byte("0")); err == nil {
+		t.Error("Expected an error for a malformed bucket")
+	}
+}
+
+//fakeRedis accepts connections and keeps a single list, which RPUSH, LRANGE
+//and LTRIM work on whatever their key. Other commands are answered with :1
+type fakeRedis struct {
+	listener net.Listener
+	lock     sync.Mutex
+	conns    []net.Conn
+	accepted int
+	list     []string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &fakeRedis{listener: listener}
+	go server.serve()
+	return server
+}
+
+func (server *fakeRedis) serve() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		server.lock.Lock()
+		server.conns = append(server.conns, conn)
+		server.accepted++
+		server.lock.Unlock()
+
+		go func() {
+			reader := bufio.NewReader(conn)
+
+			for {
+				args, err := readCommand(reader)
+				if err != nil {
+					return
+				}
+				conn.Write([]byte(server.execute(args)))
+			}
+		}()
+	}
+}
+
+//readCommand reads a command, which is an array of bulk strings
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	header, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	count, _ := strconv.Atoi(strings.TrimSpace(header[1:]))
+	args := make([]string, count)
+
+	for i := range args {
+		length, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		size, _ := strconv.Atoi(strings.TrimSpace(length[1:]))
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, arg); err != nil {
+			return nil, err
+		}
+		args[i] = string(arg[:size])
+	}
+	return args, nil
+}
+
+//execute applies a command to the list and returns its reply
+func (server *fakeRedis) execute(args []string) string {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	switch strings.ToUpper(args[0]) {
+	case "RPUSH":
+		server.list = append(server.list, args[2:]...)
+		return ":" + strconv.Itoa(len(server.list)) + "\r\n"
+	case "LRANGE":
+		start, stop := server.listRange(args[2], args[3])
+		reply := "*" + strconv.Itoa(stop-start) + "\r\n"
+		for _, item := range server.list[start:stop] {
+			reply += "$" + strconv.Itoa(len(item)) + "\r\n" + item + "\r\n"
+		}
+		return reply
+	case "LTRIM":
+		start, stop := server.listRange(args[2], args[3])
+		server.list = server.list[start:stop]
+		return "+OK\r\n"
+	default:
+		return ":1\r\n"
+	}
+}
+
+//listRange converts the inclusive, possibly negative, indexes of a list
+//command into slice bounds of the list
+func (server *fakeRedis) listRange(first string, last string) (int, int) {
+	start, _ := strconv.Atoi(first)
+	stop, _ := strconv.Atoi(last)
+
+	if stop < 0 {
+		stop += len(server.list)
+	}
+	stop++
+
+	if stop > len(server.list) {
+		stop = len(server.list)
+	}
+	if start > stop {
+		start = stop
+	}
+	return start, stop
+}
+
+//items returns a copy of the list
+func (server *fakeRedis) items() []string {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return append([]string(nil), server.list...)
+}
+
+//connections returns the number of connections which have been accepted
+func (server *fakeRedis) connections() int {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return server.accepted
+}
+
+//breakConnections closes every connection, as a restart of Redis would
+func (server *fakeRedis) breakConnections() {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	for _, conn := range server.conns {
+		conn.Close()
+	}
+	server.conns = nil
+}
+
+func TestRedisWriterReconnects(t *testing.T) {
+	server := newFakeRedis(t)
+	defer server.listener.Close()
+
+	port := server.listener.Addr().(*net.TCPAddr).Port
+	writer, err := New("redis", "redis", Settings{"url": "localhost:" + strconv.Itoa(port), "poolsize": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	if err := writer.Write(newTestBuckets("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writer.Write(newTestBuckets("c")); err != nil || server.connections() != 1 {
+		t.Fatal("Expected the pooled connection to be reused got", server.connections(), err)
+	}
+
+	//the broken connection fails at most one write, it is then replaced
+	server.breakConnections()
+	writer.Write(newTestBuckets("d"))
+
+	if err := writer.Write(newTestBuckets("e")); err != nil {
+		t.Error("Expected a new connection to be made got", err)
+	}
+
+	if server.connections() != 2 {
+		t.Error("Expected 2 connections got", server.connections())
+	}
+}
+
+func TestRedisReplay(t *testing.T) {
+	server := newFakeRedis(t)
+	defer server.listener.Close()
+
+	port := server.listener.Addr().(*net.TCPAddr).Port
+	writer, err := New("redis", "redis", Settings{"url": "localhost:" + strconv.Itoa(port), "replaybatchsize": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	redisWriter := writer.(*RedisWriter)
+	redisWriter.Write(newTestBuckets("a"))
+	//buckets pushed by earlier versions were the index of the bucket
+	server.execute([]string{"RPUSH", "aggregated", "0"})
+	redisWriter.Write(newTestBuckets("b", "c", "d"))
+
+	//a failed batch stops the replay, batches already written are removed
+	var replayed []string
+	replay := func(batch []Bucket) error {
+		for _, bucket := range batch {
+			if bucket.Name == "c" {
+				return errors.New("unavailable")
+			}
+		}
+
+		for _, bucket := range batch {
+			replayed = append(replayed, bucket.Name)
+		}
+		return nil
+	}
+
+	count, err := redisWriter.Replay(replay)
+
+	if err == nil || count != 1 || strings.Join(replayed, "") != "a" {
+		t.Error("Expected the replay to stop at the failed batch got", count, replayed, err)
+	}
+
+	if len(server.items()) != 3 {
+		t.Error("Expected the failed batch to be kept got", server.items())
+	}
+
+	replayed = nil
+	count, err = redisWriter.Replay(func(batch []Bucket) error {
+		for _, bucket := range batch {
+			replayed = append(replayed, bucket.Name)
+		}
+		return nil
+	})
+
+	if err != nil || count != 3 || strings.Join(replayed, "") != "bcd" {
+		t.Error("Expected the remaining buckets to be replayed in order got", count, replayed, err)
+	}
+
+	if len(server.items()) != 0 {
+		t.Error("Expected the list to be empty once replayed got", server.items())
+	}
+}
@@ -0,0 +1,92 @@
+package output
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+//drop policies for a full queue
+const (
+	//DropOldest discards the oldest queued batch to make room for a new one
+	DropOldest = "oldest"
+	//DropNewest discards the batch being queued
+	DropNewest = "newest"
+	//DropBlock blocks until a writer has made room, this stops aggregation
+	//while the outputs are slow
+	DropBlock = "block"
+)
+
+//Queue is a bounded queue of flushed batches waiting to be written. It
+//decouples aggregation from the outputs, so that a slow output does not stop
+//metrics from being received
+type Queue struct {
+	batches chan []Bucket
+	policy  string
+	dropped uint64
+	//pushLock ensures that evicting the oldest batch and queueing the new
+	//batch happen together when there are several producers
+	pushLock sync.Mutex
+}
+
+//NewQueue creates a queue holding up to depth batches, policy decides what
+//happens to batches pushed to a full queue
+func NewQueue(depth int, policy string) *Queue {
+	q := new(Queue)
+	q.batches = make(chan []Bucket, depth)
+	q.policy = policy
+	return q
+}
+
+//Push queues a batch, dropping a batch if the queue is full and the
+//policy allows it
+func (q *Queue) Push(batch []Bucket) {
+	if q.policy == DropBlock {
+		q.batches <- batch
+		return
+	}
+
+	q.pushLock.Lock()
+	defer q.pushLock.Unlock()
+
+	for {
+		select {
+		case q.batches <- batch:
+			return
+		default:
+		}
+
+		if q.policy == DropNewest {
+			atomic.AddUint64(&q.dropped, 1)
+			return
+		}
+
+		//a writer may have emptied the queue in the meantime, in which case
+		//nothing is dropped and the batch is queued on the next attempt
+		select {
+		case <-q.batches:
+			atomic.AddUint64(&q.dropped, 1)
+		default:
+		}
+	}
+}
+
+//Batches returns the channel writers receive queued batches from, it is
+//closed once the queue has been closed and emptied
+func (q *Queue) Batches() <-chan []Bucket {
+	return q.batches
+}
+
+//Close stops the queue accepting batches, queued batches can still be received
+func (q *Queue) Close() {
+	close(q.batches)
+}
+
+//Len returns the number of batches waiting to be written
+func (q *Queue) Len() int {
+	return len(q.batches)
+}
+
+//Dropped returns the number of batches dropped because the queue was full
+func (q *Queue) Dropped() uint64 {
+	return atomic.LoadUint64(&q.dropped)
+}
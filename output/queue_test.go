@@ -0,0 +1,45 @@
+package output
+
+import "testing"
+
+func TestQueueDropOldest(t *testing.T) {
+	q := NewQueue(2, DropOldest)
+
+	for i := 0; i < 3; i++ {
+		q.Push([]Bucket{{Name: string(rune('a' + i))}})
+	}
+
+	if q.Len() != 2 {
+		t.Error("Expected 2 queued batches got", q.Len())
+	}
+
+	if q.Dropped() != 1 {
+		t.Error("Expected 1 dropped batch got", q.Dropped())
+	}
+
+	if batch := <-q.Batches(); batch[0].Name != "b" {
+		t.Error("Expected the oldest batch to be dropped, got", batch[0].Name)
+	}
+}
+
+func TestQueueDropNewest(t *testing.T) {
+	q := NewQueue(2, DropNewest)
+
+	for i := 0; i < 3; i++ {
+		q.Push([]Bucket{{Name: string(rune('a' + i))}})
+	}
+
+	if q.Dropped() != 1 {
+		t.Error("Expected 1 dropped batch got", q.Dropped())
+	}
+
+	q.Close()
+	var names string
+	for batch := range q.Batches() {
+		names += batch[0].Name
+	}
+
+	if names != "ab" {
+		t.Error("Expected the newest batch to be dropped, got", names)
+	}
+}
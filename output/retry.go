@@ -0,0 +1,264 @@
+package output
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+//circuit breaker states
+const (
+	//BreakerClosed writes to the output as normal
+	BreakerClosed = "closed"
+	//BreakerOpen fails writes without writing to the output, so that its
+	//fallback is written straight away
+	BreakerOpen = "open"
+	//BreakerHalfOpen writes a single probe to the output to find out whether
+	//it has recovered
+	BreakerHalfOpen = "half-open"
+)
+
+//ErrBreakerOpen is returned by writes to an output whose breaker is open
+var ErrBreakerOpen = errors.New("circuit breaker is open")
+
+type (
+	//RetryConfig describes how writes to an output are retried
+	RetryConfig struct {
+		//Attempts is the number of times a write is tried, including the
+		//first attempt
+		Attempts int
+		//InitialBackoff is the longest wait before the first retry, it doubles
+		//with each retry up to MaxBackoff. The actual wait is jittered so that
+		//several writers do not retry at the same moment
+		InitialBackoff time.Duration
+		MaxBackoff     time.Duration
+	}
+
+	//BreakerConfig describes when the circuit breaker of an output opens
+	BreakerConfig struct {
+		//Failures is the number of consecutive failed writes which open the breaker
+		Failures int
+		//ResetTimeout is how long the breaker stays open before a probe is written
+		ResetTimeout time.Duration
+	}
+
+	//retryWriter retries failed writes with a jittered exponential backoff
+	retryWriter struct {
+		Writer
+		config RetryConfig
+		sleep  func(time.Duration)
+	}
+
+	//CircuitBreaker stops writing to an output after consecutive failures so
+	//that its fallback is used without waiting for the output to fail again,
+	//after a timeout a single write probes whether the output has recovered
+	CircuitBreaker struct {
+		Writer
+		config   BreakerConfig
+		lock     sync.Mutex
+		state    string
+		failures int
+		openedAt time.Time
+		now      func() time.Time
+	}
+)
+
+var (
+	//jitter is shared by every retrying output, rand.Rand is not safe for
+	//concurrent use so it is locked
+	jitter     = rand.New(rand.NewSource(time.Now().UnixNano()))
+	jitterLock sync.Mutex
+)
+
+//NewRetryConfig reads the retry settings of an output, i.e.
+//attempts: 3
+//initialBackoff: 500
+//maxBackoff: 10000
+//backoffs are in milliseconds
+func NewRetryConfig(name string, settings Settings) (RetryConfig, error) {
+	var config RetryConfig
+
+	attempts, err := settings.Int("attempts", 3)
+	if err != nil {
+		return config, err
+	}
+
+	initialBackoff, err := settings.Int("initialBackoff", 500)
+	if err != nil {
+		return config, err
+	}
+
+	maxBackoff, err := settings.Int("maxBackoff", 10000)
+	if err != nil {
+		return config, err
+	}
+
+	if attempts < 1 || initialBackoff < 0 || maxBackoff < initialBackoff {
+		return config, fmt.Errorf("output %s: retry attempts must be at least 1 and maxBackoff at least initialBackoff", name)
+	}
+
+	config.Attempts = int(attempts)
+	config.InitialBackoff = time.Duration(initialBackoff) * time.Millisecond
+	config.MaxBackoff = time.Duration(maxBackoff) * time.Millisecond
+	return config, nil
+}
+
+//NewBreakerConfig reads the circuit breaker settings of an output, i.e.
+//failures: 5
+//resetTimeout: 30
+//the reset timeout is in seconds
+func NewBreakerConfig(name string, settings Settings) (BreakerConfig, error) {
+	var config BreakerConfig
+
+	failures, err := settings.Int("failures", 5)
+	if err != nil {
+		return config, err
+	}
+
+	resetTimeout, err := settings.Int("resetTimeout", 30)
+	if err != nil {
+		return config, err
+	}
+
+	if failures < 1 || resetTimeout < 1 {
+		return config, fmt.Errorf("output %s: circuit breaker failures and resetTimeout must be at least 1", name)
+	}
+
+	config.Failures = int(failures)
+	config.ResetTimeout = time.Duration(resetTimeout) * time.Second
+	return config, nil
+}
+
+//WithRetries returns an output which retries failed writes to writer
+func WithRetries(writer Writer, config RetryConfig) Writer {
+	return &retryWriter{Writer: writer, config: config, sleep: time.Sleep}
+}
+
+//Write retries the buckets which have not been written until every attempt
+//has been made. If a retry only wrote some of the buckets the error is a
+//*PartialWriteError, so that the buckets already written are not written
+//again by a fallback or spool
+func (w *retryWriter) Write(buckets []Bucket) error {
+	var err error
+	var partial *PartialWriteError
+	backoff := w.config.InitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		err = w.Writer.Write(buckets)
+
+		if err == nil {
+			return nil
+		}
+
+		if attemptPartial, ok := err.(*PartialWriteError); ok && partial == nil {
+			partial = attemptPartial
+		}
+
+		if attempt >= w.config.Attempts {
+			break
+		}
+
+		//only the buckets which were not written are retried
+		buckets = FailedBuckets(buckets, err)
+
+		log.Printf("%s write failed, retrying in up to %s", w.Writer.Name(), backoff)
+		w.sleep(jittered(backoff))
+
+		backoff *= 2
+		if backoff > w.config.MaxBackoff {
+			backoff = w.config.MaxBackoff
+		}
+	}
+
+	//a retry which failed entirely still only failed the remaining buckets
+	if _, ok := err.(*PartialWriteError); !ok && partial != nil {
+		return &PartialWriteError{Failed: buckets, Errors: []error{err}, Chunks: partial.Chunks}
+	}
+	return err
+}
+
+//jittered returns a random duration between half of backoff and backoff
+func jittered(backoff time.Duration) time.Duration {
+	if backoff <= 1 {
+		return backoff
+	}
+
+	jitterLock.Lock()
+	defer jitterLock.Unlock()
+
+	return backoff/2 + time.Duration(jitter.Int63n(int64(backoff/2)+1))
+}
+
+//WithCircuitBreaker returns an output which stops writing to writer while
+//it is failing
+func WithCircuitBreaker(writer Writer, config BreakerConfig) *CircuitBreaker {
+	return &CircuitBreaker{Writer: writer, config: config, state: BreakerClosed, now: time.Now}
+}
+
+//Write writes to the output unless the breaker is open, in which case
+//ErrBreakerOpen is returned straight away
+func (b *CircuitBreaker) Write(buckets []Bucket) error {
+	if !b.allow() {
+		return ErrBreakerOpen
+	}
+
+	err := b.Writer.Write(buckets)
+	b.record(err)
+	return err
+}
+
+//State returns whether the breaker is closed, open or half-open
+func (b *CircuitBreaker) State() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.state
+}
+
+//allow reports whether a write may be made, once the reset timeout has
+//passed a single write is allowed as a probe
+func (b *CircuitBreaker) allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.state {
+	case BreakerClosed:
+		return true
+	case BreakerOpen:
+		if b.now().Sub(b.openedAt) < b.config.ResetTimeout {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		return true
+	default:
+		//a probe is already being written
+		return false
+	}
+}
+
+func (b *CircuitBreaker) record(err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if err == nil {
+		if b.state != BreakerClosed {
+			log.Printf("%s has recovered, closing its circuit breaker", b.Writer.Name())
+		}
+		b.state = BreakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+
+	if b.state == BreakerHalfOpen || b.failures >= b.config.Failures {
+		if b.state != BreakerOpen {
+			log.Printf("%s has failed %d times in a row, opening its circuit breaker", b.Writer.Name(), b.failures)
+		}
+		b.state = BreakerOpen
+		b.openedAt = b.now()
+	}
+}
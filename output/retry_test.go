@@ -0,0 +1,107 @@
+package output
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetries(t *testing.T) {
+	primary := &testWriter{name: "influxdb", err: errors.New("unavailable")}
+	writer := WithRetries(primary, RetryConfig{Attempts: 4, InitialBackoff: 100 * time.Millisecond, MaxBackoff: 300 * time.Millisecond})
+
+	var waits []time.Duration
+	writer.(*retryWriter).sleep = func(wait time.Duration) {
+		waits = append(waits, wait)
+	}
+
+	if err := writer.Write([]Bucket{{Name: "requests"}}); err == nil {
+		t.Error("Expected an error once every attempt has failed")
+	}
+
+	if len(primary.written) != 4 || len(waits) != 3 {
+		t.Fatal("Expected 4 attempts and 3 waits got", len(primary.written), len(waits))
+	}
+
+	limits := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond}
+	for i, wait := range waits {
+		if wait < limits[i]/2 || wait > limits[i] {
+			t.Error("Expected a wait between", limits[i]/2, "and", limits[i], "got", wait)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	primary := &testWriter{name: "influxdb", err: errors.New("unavailable")}
+	breaker := WithCircuitBreaker(primary, BreakerConfig{Failures: 2, ResetTimeout: time.Minute})
+	now := time.Unix(1461204540, 0)
+	breaker.now = func() time.Time { return now }
+	buckets := []Bucket{{Name: "requests"}}
+
+	breaker.Write(buckets)
+	breaker.Write(buckets)
+
+	if breaker.State() != BreakerOpen {
+		t.Fatal("Expected the breaker to open after 2 failures got", breaker.State())
+	}
+
+	if err := breaker.Write(buckets); err != ErrBreakerOpen || len(primary.written) != 2 {
+		t.Error("Expected an open breaker not to write to the output")
+	}
+
+	//once the reset timeout has passed a probe is written
+	now = now.Add(time.Minute)
+	primary.err = nil
+
+	if err := breaker.Write(buckets); err != nil || breaker.State() != BreakerClosed {
+		t.Error("Expected a successful probe to close the breaker got", breaker.State())
+	}
+}
+
+//failingWriter fails to write the buckets called failing, a write which
+//fails only some of its buckets returns a *PartialWriteError
+type failingWriter struct {
+	testWriter
+	failing string
+}
+
+func (w *failingWriter) Write(buckets []Bucket) error {
+	w.written = append(w.written, buckets)
+	partial := &PartialWriteError{Chunks: len(buckets)}
+
+	for _, bucket := range buckets {
+		if bucket.Name == w.failing {
+			partial.Failed = append(partial.Failed, bucket)
+			partial.Errors = append(partial.Errors, errors.New("unavailable"))
+		}
+	}
+
+	if len(partial.Failed) == 0 {
+		return nil
+	} else if len(partial.Failed) == len(buckets) {
+		return partial.Errors[0]
+	}
+	return partial
+}
+
+func TestRetriesFallbackPartialWrite(t *testing.T) {
+	primary := &failingWriter{testWriter: testWriter{name: "influxdb"}, failing: "errors"}
+	retries := WithRetries(primary, RetryConfig{Attempts: 2})
+	retries.(*retryWriter).sleep = func(time.Duration) {}
+
+	fallback := &testWriter{name: "redis"}
+	writer := WithFallback(retries, fallback)
+
+	if err := writer.Write([]Bucket{{Name: "requests"}, {Name: "errors"}}); err != nil {
+		t.Error("Expected the failed bucket to be written to the fallback got", err)
+	}
+
+	//only the bucket which failed is retried and written to the fallback
+	if len(primary.written) != 2 || len(primary.written[1]) != 1 {
+		t.Error("Expected the failed bucket alone to be retried got", primary.written)
+	}
+
+	if len(fallback.written) != 1 || len(fallback.written[0]) != 1 || fallback.written[0][0].Name != "errors" {
+		t.Error("Expected only the failed bucket to be written to the fallback got", fallback.written)
+	}
+}
@@ -0,0 +1,508 @@
+package output
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//fsync policies of a spool
+const (
+	//FsyncAlways syncs every batch to disk as it is spooled
+	FsyncAlways = "always"
+	//FsyncSegment syncs a segment to disk once it is full
+	FsyncSegment = "segment"
+	//FsyncNever leaves syncing to the operating system
+	FsyncNever = "never"
+)
+
+//segmentSuffix is the extension of segment files, segments are named by
+//their sequence number so that they sort in the order they were written
+const segmentSuffix = ".seg"
+
+type (
+	//SpoolConfig describes where and how failed batches are spooled
+	SpoolConfig struct {
+		Directory string
+		//SegmentSize is the size in bytes at which a new segment is started
+		SegmentSize int64
+		//MaxSize and MaxAge cap the spool, the oldest segments are deleted
+		//once the spool is larger or older than them. Zero is unlimited
+		MaxSize int64
+		MaxAge  time.Duration
+		Fsync   string
+	}
+
+	//Spool is an on disk queue of batches which could not be written. Batches
+	//are appended to segment files which are deleted once they are replayed
+	Spool struct {
+		config SpoolConfig
+		lock   sync.Mutex
+		//segments are the sequence numbers of every segment, oldest first,
+		//the last segment is being appended to if active is open
+		segments   []int64
+		sizes      map[int64]int64
+		active     *os.File
+		activeSize int64
+		totalSize  int64
+	}
+
+	//spooledBucket is the part of a bucket which is written. Buckets have
+	//been summarised before they are spooled, but replays are written through
+	//the same wrappers as new batches, which need the type and interval to
+	//add counter rates. Batches spooled without them are replayed without rates
+	spooledBucket struct {
+		Name      string
+		Timestamp time.Time
+		Tags      map[string]string
+		Type      string
+		Interval  int
+		Fields    map[string]interface{}
+	}
+
+	//spoolWriter spools batches which an output fails to write and replays
+	//them before writing new batches once the output has recovered
+	spoolWriter struct {
+		Writer
+		spool *Spool
+		lock  sync.Mutex
+	}
+)
+
+//NewSpoolConfig reads the spool settings of an output, i.e.
+//directory: /var/spool/aggregated
+//segmentSize: 8388608
+//maxSize: 1073741824
+//maxAge: 86400
+//fsync: always
+func NewSpoolConfig(name string, settings Settings) (SpoolConfig, error) {
+	var config SpoolConfig
+	var err error
+
+	if config.Directory, err = settings.require(name, "directory"); err != nil {
+		return config, err
+	}
+
+	if config.SegmentSize, err = settings.Int("segmentSize", 8*1024*1024); err != nil {
+		return config, err
+	}
+
+	if config.MaxSize, err = settings.Int("maxSize", 1024*1024*1024); err != nil {
+		return config, err
+	}
+
+	maxAge, err := settings.Int("maxAge", 24*60*60)
+	if err != nil {
+		return config, err
+	}
+	config.MaxAge = time.Duration(maxAge) * time.Second
+
+	if config.SegmentSize < 1 || config.MaxSize < 0 || config.MaxAge < 0 {
+		return config, fmt.Errorf("output %s: spool sizes and age must not be negative", name)
+	}
+
+	config.Fsync = settings.String("fsync", FsyncAlways)
+
+	switch config.Fsync {
+	case FsyncAlways, FsyncSegment, FsyncNever:
+	default:
+		return config, fmt.Errorf("output %s: spool fsync must be always, segment or never", name)
+	}
+
+	return config, nil
+}
+
+//OpenSpool opens the spool in config.Directory, creating it if needed.
+//Segments left by a previous run are kept to be replayed
+func OpenSpool(config SpoolConfig) (*Spool, error) {
+	err := os.MkdirAll(config.Directory, 0755)
+
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(config.Directory)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s := new(Spool)
+	s.config = config
+	s.sizes = make(map[int64]int64)
+
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), segmentSuffix) {
+			continue
+		}
+
+		sequence, err := strconv.ParseInt(strings.TrimSuffix(file.Name(), segmentSuffix), 10, 64)
+
+		if err != nil {
+			continue
+		}
+
+		s.segments = append(s.segments, sequence)
+		s.sizes[sequence] = file.Size()
+		s.totalSize += file.Size()
+	}
+
+	sort.Sort(sequences(s.segments))
+
+	if len(s.segments) > 0 {
+		log.Printf("Spool %s has %d segments to replay", config.Directory, len(s.segments))
+	}
+
+	return s, nil
+}
+
+//WithSpool returns an output which spools batches that writer fails to write
+//and replays them, in the order they were spooled, once writer recovers
+func WithSpool(writer Writer, spool *Spool) Writer {
+	return &spoolWriter{Writer: writer, spool: spool}
+}
+
+//Write replays any spooled batches and then writes buckets, if the output is
+//still failing buckets are spooled behind the batches already spooled so
+//that the order of batches is kept. An error is only returned if buckets
+//could be neither written nor spooled
+func (w *spoolWriter) Write(buckets []Bucket) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.spool.Pending() {
+		//buckets are not written while spooled batches remain, so that they
+		//are spooled behind them
+		if err := w.spool.Replay(w.Writer.Write); err != nil {
+			log.Printf("%s replay failed, spooling %d points to %s", w.Writer.Name(), len(buckets), w.spool.config.Directory)
+			return w.spool.Append(buckets)
+		}
+	}
+
+	err := w.Writer.Write(buckets)
+
+	if err == nil {
+		return nil
+	}
+
+	//only the buckets which were not written are spooled
+	failed := FailedBuckets(buckets, err)
+	log.Printf("%s write failed, spooling %d points to %s", w.Writer.Name(), len(failed), w.spool.config.Directory)
+	return w.spool.Append(failed)
+}
+
+func (w *spoolWriter) Close() error {
+	err := w.Writer.Close()
+	spoolErr := w.spool.Close()
+
+	if err != nil {
+		return err
+	}
+	return spoolErr
+}
+
+//Pending reports whether there are batches waiting to be replayed
+func (s *Spool) Pending() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.segments) > 0
+}
+
+//Append writes a batch to the end of the spool
+func (s *Spool) Append(batch []Bucket) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	record, err := encodeBatch(batch)
+
+	if err != nil {
+		return err
+	}
+
+	if s.active == nil || s.activeSize >= s.config.SegmentSize {
+		if err := s.startSegment(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := s.active.Write(record); err != nil {
+		return err
+	}
+
+	sequence := s.segments[len(s.segments)-1]
+	s.activeSize += int64(len(record))
+	s.sizes[sequence] = s.activeSize
+	s.totalSize += int64(len(record))
+
+	if s.config.Fsync == FsyncAlways {
+		if err := s.active.Sync(); err != nil {
+			return err
+		}
+	}
+
+	s.enforceCaps()
+	return nil
+}
+
+//Replay writes every spooled batch, oldest first, stopping at the first
+//batch which cannot be written. Replayed segments are deleted
+func (s *Spool) Replay(write func([]Bucket) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.enforceCaps()
+
+	//new batches are appended to a new segment while the spool is replayed
+	if err := s.closeActive(); err != nil {
+		return err
+	}
+
+	for len(s.segments) > 0 {
+		sequence := s.segments[0]
+		batches, err := s.readSegment(sequence)
+
+		if err != nil {
+			return err
+		}
+
+		for i, batch := range batches {
+			if err := write(batch); err != nil {
+				//the segment is rewritten without the batches, or the parts of
+				//the batch, which have been written so they are not written twice
+				remaining := batches[i:]
+				failed := FailedBuckets(batch, err)
+
+				if i > 0 || len(failed) != len(batch) {
+					remaining[0] = failed
+					s.rewriteSegment(sequence, remaining)
+				}
+				return err
+			}
+		}
+
+		log.Printf("Replayed %d spooled batches from %s", len(batches), s.path(sequence))
+		s.removeSegment(sequence)
+	}
+
+	return nil
+}
+
+//Close syncs and closes the segment being appended to, the spool is kept on
+//disk to be replayed by the next run
+func (s *Spool) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.closeActive()
+}
+
+func (s *Spool) path(sequence int64) string {
+	return filepath.Join(s.config.Directory, fmt.Sprintf("%020d%s", sequence, segmentSuffix))
+}
+
+func (s *Spool) startSegment() error {
+	if err := s.closeActive(); err != nil {
+		return err
+	}
+
+	var sequence int64
+	if len(s.segments) > 0 {
+		sequence = s.segments[len(s.segments)-1] + 1
+	}
+
+	file, err := os.OpenFile(s.path(sequence), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	s.active = file
+	s.activeSize = 0
+	s.segments = append(s.segments, sequence)
+	s.sizes[sequence] = 0
+	return nil
+}
+
+func (s *Spool) closeActive() error {
+	if s.active == nil {
+		return nil
+	}
+
+	var err error
+	if s.config.Fsync != FsyncNever {
+		err = s.active.Sync()
+	}
+
+	closeErr := s.active.Close()
+	s.active = nil
+
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func (s *Spool) removeSegment(sequence int64) {
+	if err := os.Remove(s.path(sequence)); err != nil && !os.IsNotExist(err) {
+		log.Println(err)
+	}
+
+	for i := range s.segments {
+		if s.segments[i] == sequence {
+			s.segments = append(s.segments[:i], s.segments[i+1:]...)
+			break
+		}
+	}
+
+	s.totalSize -= s.sizes[sequence]
+	delete(s.sizes, sequence)
+}
+
+//enforceCaps deletes the oldest segments while the spool is over its maximum
+//size and any segments older than the maximum age, the segment being
+//appended to is never deleted
+func (s *Spool) enforceCaps() {
+	for len(s.segments) > 0 {
+		sequence := s.segments[0]
+
+		if s.active != nil && len(s.segments) == 1 {
+			return
+		}
+
+		expired := false
+		if s.config.MaxAge > 0 {
+			info, err := os.Stat(s.path(sequence))
+			expired = err == nil && time.Since(info.ModTime()) > s.config.MaxAge
+		}
+
+		oversized := s.config.MaxSize > 0 && s.totalSize > s.config.MaxSize
+
+		if !expired && !oversized {
+			return
+		}
+
+		log.Printf("WARNING: spool %s is over its size or age limit, %s has been dropped", s.config.Directory, s.path(sequence))
+		s.removeSegment(sequence)
+	}
+}
+
+//readSegment reads every batch in a segment, a batch which was only partly
+//written, i.e. because of a crash, ends the segment
+func (s *Spool) readSegment(sequence int64) ([][]Bucket, error) {
+	file, err := os.Open(s.path(sequence))
+
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var batches [][]Bucket
+	header := make([]byte, 8)
+
+	for {
+		if _, err := io.ReadFull(file, header); err != nil {
+			if err != io.EOF {
+				log.Printf("Spool segment %s ends with an incomplete batch", s.path(sequence))
+			}
+			return batches, nil
+		}
+
+		payload := make([]byte, binary.BigEndian.Uint32(header[:4]))
+
+		if _, err := io.ReadFull(file, payload); err != nil || crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			log.Printf("Spool segment %s ends with an incomplete batch", s.path(sequence))
+			return batches, nil
+		}
+
+		batch, err := decodeBatch(payload)
+
+		if err != nil {
+			return nil, err
+		}
+		batches = append(batches, batch)
+	}
+}
+
+func (s *Spool) rewriteSegment(sequence int64, batches [][]Bucket) {
+	var segment bytes.Buffer
+
+	for _, batch := range batches {
+		record, err := encodeBatch(batch)
+
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		segment.Write(record)
+	}
+
+	temporary := s.path(sequence) + ".tmp"
+
+	if err := ioutil.WriteFile(temporary, segment.Bytes(), 0644); err != nil {
+		log.Println(err)
+		return
+	}
+
+	if err := os.Rename(temporary, s.path(sequence)); err != nil {
+		log.Println(err)
+		return
+	}
+
+	s.totalSize += int64(segment.Len()) - s.sizes[sequence]
+	s.sizes[sequence] = int64(segment.Len())
+}
+
+//encodeBatch encodes a batch as a record of its length, a checksum and the
+//gob encoded buckets. gob is used rather than JSON so that the types of
+//fields, i.e. integers, are the same when replayed
+func encodeBatch(batch []Bucket) ([]byte, error) {
+	spooled := make([]spooledBucket, len(batch))
+
+	for i, bucket := range batch {
+		spooled[i] = spooledBucket{Name: bucket.Name, Timestamp: bucket.Timestamp, Tags: bucket.Tags, Type: bucket.Type, Interval: bucket.Interval, Fields: bucket.Fields}
+	}
+
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(spooled); err != nil {
+		return nil, err
+	}
+
+	record := make([]byte, 8, 8+payload.Len())
+	binary.BigEndian.PutUint32(record[:4], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload.Bytes()))
+	return append(record, payload.Bytes()...), nil
+}
+
+func decodeBatch(payload []byte) ([]Bucket, error) {
+	var spooled []spooledBucket
+
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&spooled); err != nil {
+		return nil, err
+	}
+
+	batch := make([]Bucket, len(spooled))
+	for i, bucket := range spooled {
+		batch[i] = Bucket{Name: bucket.Name, Timestamp: bucket.Timestamp, Tags: bucket.Tags, Type: bucket.Type, Interval: bucket.Interval, Fields: bucket.Fields}
+	}
+	return batch, nil
+}
+
+//sequences sorts segment sequence numbers
+type sequences []int64
+
+func (s sequences) Len() int           { return len(s) }
+func (s sequences) Less(i, j int) bool { return s[i] < s[j] }
+func (s sequences) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
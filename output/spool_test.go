@@ -0,0 +1,138 @@
+package output
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestSpool(t *testing.T, config SpoolConfig) *Spool {
+	spool, err := OpenSpool(config)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spool
+}
+
+func TestSpoolReplay(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(directory)
+
+	config := SpoolConfig{Directory: directory, SegmentSize: 1, Fsync: FsyncNever}
+	spool := newTestSpool(t, config)
+
+	for _, name := range []string{"a", "b", "c"} {
+		batch := []Bucket{{Name: name, Timestamp: time.Unix(1461204540, 0), Fields: map[string]interface{}{"count": int64(3)}}}
+
+		if err := spool.Append(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//the spool is read again after a restart
+	spool.Close()
+	spool = newTestSpool(t, config)
+
+	var replayed string
+	failing := func(batch []Bucket) error {
+		if batch[0].Name == "b" {
+			return errors.New("unavailable")
+		}
+		replayed += batch[0].Name
+		return nil
+	}
+
+	if err := spool.Replay(failing); err == nil || replayed != "a" {
+		t.Error("Expected replay to stop at the failed batch, replayed", replayed)
+	}
+
+	replayed = ""
+	var count interface{}
+	err := spool.Replay(func(batch []Bucket) error {
+		replayed += batch[0].Name
+		count = batch[0].Fields["count"]
+		return nil
+	})
+
+	if err != nil || replayed != "bc" {
+		t.Error("Expected the remaining batches to be replayed in order, replayed", replayed)
+	}
+
+	if count != int64(3) {
+		t.Errorf("Expected field types to be kept, got %T", count)
+	}
+
+	if spool.Pending() {
+		t.Error("Expected the spool to be empty once replayed")
+	}
+}
+
+func TestSpoolMaxSize(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(directory)
+
+	spool := newTestSpool(t, SpoolConfig{Directory: directory, SegmentSize: 1, MaxSize: 1, Fsync: FsyncNever})
+
+	for _, name := range []string{"a", "b", "c"} {
+		spool.Append([]Bucket{{Name: name}})
+	}
+
+	var replayed string
+	spool.Replay(func(batch []Bucket) error {
+		replayed += batch[0].Name
+		return nil
+	})
+
+	if replayed != "c" {
+		t.Error("Expected the oldest batches to be dropped, replayed", replayed)
+	}
+}
+
+func TestSpoolWriter(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(directory)
+
+	primary := &testWriter{name: "influxdb", err: errors.New("unavailable")}
+	writer := WithSpool(primary, newTestSpool(t, SpoolConfig{Directory: directory, SegmentSize: 1024, Fsync: FsyncNever}))
+
+	if err := writer.Write([]Bucket{{Name: "a"}}); err != nil {
+		t.Error("Expected a failed batch to be spooled got", err)
+	}
+
+	primary.err = nil
+	primary.written = nil
+	writer.Write([]Bucket{{Name: "b"}})
+
+	if len(primary.written) != 2 || primary.written[0][0].Name != "a" || primary.written[1][0].Name != "b" {
+		t.Error("Expected the spooled batch to be written before the new batch got", primary.written)
+	}
+}
+
+//TestSpoolCounterRates checks that a counter replayed from the spool has its
+//rate added by the counter rate writer which the spool wraps
+func TestSpoolCounterRates(t *testing.T) {
+	directory, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(directory)
+
+	primary := &testWriter{name: "influxdb", err: errors.New("unavailable")}
+	rated := WithCounterRateWriter(primary, CounterRateWindow, 10)
+	writer := WithSpool(rated, newTestSpool(t, SpoolConfig{Directory: directory, SegmentSize: 1024, Fsync: FsyncNever}))
+
+	counter := Bucket{Name: "requests", Type: "counter", Interval: 10, Fields: map[string]interface{}{"value": 50.0}}
+	writer.Write([]Bucket{counter})
+
+	primary.err = nil
+	primary.written = nil
+	writer.Write(nil)
+
+	if len(primary.written) == 0 || len(primary.written[0]) != 1 {
+		t.Fatal("Expected the spooled counter to be replayed got", primary.written)
+	}
+
+	if rate := primary.written[0][0].Fields["rate"]; rate != 5.0 {
+		t.Error("Expected the replayed counter to have a rate of 5 got", rate)
+	}
+}
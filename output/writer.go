@@ -0,0 +1,160 @@
+package output
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cast"
+)
+
+type (
+	//Writer is an output which flushed buckets are written to, outputs are
+	//created from the config by the factory registered for their type
+	Writer interface {
+		Name() string
+		Write(buckets []Bucket) error
+		Close() error
+	}
+
+	//Settings are the options of a single output as read from the config,
+	//keys are case insensitive
+	Settings map[string]interface{}
+
+	//Factory creates an output called name from its settings
+	Factory func(name string, settings Settings) (Writer, error)
+
+	//fallbackWriter writes to a second output when the first fails
+	fallbackWriter struct {
+		Writer
+		fallback Writer
+	}
+)
+
+var factories = make(map[string]Factory)
+
+//Register makes an output type available to the config, it is intended to be
+//called from the init function of the file implementing the output
+func Register(outputType string, factory Factory) {
+	if _, exists := factories[outputType]; exists {
+		panic("output type " + outputType + " registered twice")
+	}
+	factories[outputType] = factory
+}
+
+//New creates an output of a registered type
+func New(outputType string, name string, settings Settings) (Writer, error) {
+	factory, ok := factories[outputType]
+
+	if !ok {
+		return nil, fmt.Errorf("unknown output type %q", outputType)
+	}
+
+	return factory(name, settings)
+}
+
+//WithFallback returns an output which writes to fallback whenever a write
+//to primary fails, closing it closes both outputs
+func WithFallback(primary Writer, fallback Writer) Writer {
+	return &fallbackWriter{Writer: primary, fallback: fallback}
+}
+
+func (w *fallbackWriter) Write(buckets []Bucket) error {
+	err := w.Writer.Write(buckets)
+
+	if err == nil {
+		return nil
+	}
+
+	//only the buckets which were not written are written to the fallback
+	failed := FailedBuckets(buckets, err)
+	log.Printf("%s write failed, attempting to write %d points to %s", w.Writer.Name(), len(failed), w.fallback.Name())
+	return w.fallback.Write(failed)
+}
+
+func (w *fallbackWriter) Close() error {
+	err := w.Writer.Close()
+	fallbackErr := w.fallback.Close()
+
+	if err != nil {
+		return err
+	}
+	return fallbackErr
+}
+
+//String returns a setting as a string, or def if it is not set or empty
+func (settings Settings) String(key string, def string) string {
+	value, ok := settings[strings.ToLower(key)]
+
+	if !ok || value == nil || fmt.Sprint(value) == "" {
+		return def
+	}
+	return fmt.Sprint(value)
+}
+
+//Int returns a setting as a whole number, or def if it is not set
+func (settings Settings) Int(key string, def int64) (int64, error) {
+	value := settings.String(key, "")
+
+	if value == "" {
+		return def, nil
+	}
+
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a whole number", key)
+	}
+	return parsed, nil
+}
+
+//Bool returns a setting as true or false, or def if it is not set
+func (settings Settings) Bool(key string, def bool) (bool, error) {
+	value := settings.String(key, "")
+
+	if value == "" {
+		return def, nil
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%s must be true or false", key)
+	}
+	return parsed, nil
+}
+
+//Section returns settings nested within a setting, i.e. the spool settings
+//of an output, it is nil if the setting is not set
+func (settings Settings) Section(key string) (Settings, error) {
+	value, ok := settings[strings.ToLower(key)]
+
+	if !ok || value == nil {
+		return nil, nil
+	}
+
+	//YAML maps are decoded with interface{} keys by some versions of viper
+	var rawSettings map[string]interface{}
+	switch value.(type) {
+	case map[string]interface{}, map[interface{}]interface{}:
+		rawSettings = cast.ToStringMap(value)
+	default:
+		return nil, fmt.Errorf("%s must be a map of settings", key)
+	}
+
+	//viper does not make keys within lists case insensitive
+	section := make(Settings, len(rawSettings))
+	for k, v := range rawSettings {
+		section[strings.ToLower(k)] = v
+	}
+	return section, nil
+}
+
+//require returns a setting which must be set, it is an error for it to be empty
+func (settings Settings) require(name string, key string) (string, error) {
+	value := settings.String(key, "")
+
+	if value == "" {
+		return "", fmt.Errorf("output %s: %s undefined", name, key)
+	}
+	return value, nil
+}
@@ -0,0 +1,72 @@
+package output
+
+import (
+	"errors"
+	"testing"
+)
+
+type testWriter struct {
+	name    string
+	err     error
+	written [][]Bucket
+}
+
+func (w *testWriter) Name() string {
+	return w.name
+}
+
+func (w *testWriter) Write(buckets []Bucket) error {
+	w.written = append(w.written, buckets)
+	return w.err
+}
+
+func (w *testWriter) Close() error {
+	return nil
+}
+
+func TestRegistry(t *testing.T) {
+	writer, err := New("json", "debug", Settings{"url": "http://localhost:9000/metrics"})
+
+	if err != nil {
+		t.Fatal("Expected a json output got", err)
+	}
+
+	if writer.Name() != "debug" {
+		t.Error("Expected the output to be named debug got", writer.Name())
+	}
+
+	if _, err := New("influxdb", "influxdb", Settings{"url": "http://localhost:8086"}); err == nil {
+		t.Error("Expected an error for an InfluxDB output without credentials")
+	}
+
+	if _, err := New("redis", "redis", Settings{"url": "localhost:6379", "replaybatchsize": 0}); err == nil {
+		t.Error("Expected an error for a Redis output which replays no buckets at a time")
+	}
+
+	if _, err := New("carbon", "carbon", Settings{}); err == nil {
+		t.Error("Expected an error for an unknown output type")
+	}
+}
+
+func TestWithFallback(t *testing.T) {
+	primary := &testWriter{name: "influxdb"}
+	fallback := &testWriter{name: "redis"}
+	writer := WithFallback(primary, fallback)
+	buckets := []Bucket{{Name: "requests"}}
+
+	if err := writer.Write(buckets); err != nil || len(fallback.written) != 0 {
+		t.Error("Expected the fallback not to be written while the primary output succeeds")
+	}
+
+	primary.err = errors.New("unavailable")
+
+	if err := writer.Write(buckets); err != nil || len(fallback.written) != 1 {
+		t.Error("Expected the fallback to be written when the primary output fails")
+	}
+
+	fallback.err = errors.New("unavailable")
+
+	if err := writer.Write(buckets); err == nil {
+		t.Error("Expected an error when both outputs fail")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/ccpgames/aggregateD/health"
+)
+
+//replayRedis drains the Redis fallbacks of InfluxDB outputs back into
+//InfluxDB, fallbacks are checked every flush interval and only replayed
+//while InfluxDB is healthy. Returns once stop is closed and any replay in
+//progress has finished
+func replayRedis(stop <-chan struct{}) {
+	t := time.NewTicker(time.Duration(configuration.FlushInterval) * time.Second)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-stop:
+			return
+		}
+
+		for _, replay := range configuration.RedisReplays {
+			if !health.InfluxDBHealthy(replay.InfluxConfig) {
+				continue
+			}
+
+			replayed, err := replay.Fallback.Replay(replay.Output.Write)
+
+			if replayed > 0 {
+				log.Printf("Replayed %d points from %s into %s", replayed, replay.Fallback.Name(), replay.Output.Name())
+			}
+
+			if err != nil {
+				log.Printf("Replaying %s into %s failed: %s", replay.Fallback.Name(), replay.Output.Name(), err)
+			}
+		}
+	}
+}
+
+//replayRedisOnce drains the Redis fallbacks of InfluxDB outputs back into
+//InfluxDB and returns, it is run by the replay-redis command. Returns false
+//if any fallback could not be replayed
+func replayRedisOnce() bool {
+	ok := true
+
+	if len(configuration.RedisReplays) == 0 {
+		log.Print("No InfluxDB outputs have a Redis fallback")
+	}
+
+	for _, replay := range configuration.RedisReplays {
+		replayed, err := replay.Fallback.Replay(replay.Output.Write)
+		log.Printf("Replayed %d points from %s into %s", replayed, replay.Fallback.Name(), replay.Output.Name())
+
+		if err != nil {
+			log.Printf("Replaying %s into %s failed: %s", replay.Fallback.Name(), replay.Output.Name(), err)
+			ok = false
+		}
+	}
+
+	return ok
+}
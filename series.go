@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+
+	"github.com/ccpgames/aggregateD/input"
+)
+
+//seriesKey identifies a series, metrics with the same seriesKey are aggregated
+//together. Identity is a canonical encoding of the metric name, its tags and
+//any secondary data configured as part of the identity. The tags are sorted so
+//that the same tags always encode identically, regardless of map ordering.
+//Hash is a hash of the identity, used to spread series between shards.
+type seriesKey struct {
+	Hash     uint64
+	Identity string
+}
+
+//newSeriesKey returns the key of the series a metric belongs to. Secondary
+//data is only part of the identity if it is one of identityFields, so that
+//data such as the source address does not split a series in two.
+func newSeriesKey(metric input.Metric, identityFields []string) seriesKey {
+	var identity bytes.Buffer
+
+	writeIdentityPart(&identity, metric.Name)
+	encodeTags(&identity, metric.Tags)
+
+	for _, field := range identityFields {
+		if value, ok := metric.SecondaryData[field]; ok {
+			writeIdentityPart(&identity, field)
+			writeIdentityPart(&identity, fmt.Sprint(value))
+		}
+	}
+
+	hasher := fnv.New64a()
+	hasher.Write(identity.Bytes())
+
+	return seriesKey{
+		Hash:     hasher.Sum64(),
+		Identity: identity.String(),
+	}
+}
+
+//encodeTags writes the tags to an identity in order of their keys
+func encodeTags(identity *bytes.Buffer, tags map[string]string) {
+	keys := make([]string, 0, len(tags))
+
+	for k := range tags {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		writeIdentityPart(identity, k)
+		writeIdentityPart(identity, tags[k])
+	}
+}
+
+//writeIdentityPart writes a length prefixed string, the prefix ensures that
+//names, tags and values containing separators can't produce the same identity
+func writeIdentityPart(identity *bytes.Buffer, part string) {
+	identity.WriteString(strconv.Itoa(len(part)))
+	identity.WriteByte(':')
+	identity.WriteString(part)
+}
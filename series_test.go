@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ccpgames/aggregateD/input"
+)
+
+func TestSeriesKey(t *testing.T) {
+	first := input.Metric{
+		Name:          "requests",
+		Tags:          map[string]string{"env": "prod", "host": "web1", "dc": "lon"},
+		SecondaryData: map[string]interface{}{"source": "10.0.0.1", "region": "eu"},
+	}
+	second := input.Metric{
+		Name:          "requests",
+		Tags:          map[string]string{"dc": "lon", "host": "web1", "env": "prod"},
+		SecondaryData: map[string]interface{}{"source": "10.0.0.2", "region": "eu"},
+	}
+
+	if newSeriesKey(first, nil) != newSeriesKey(second, nil) {
+		t.Error("Expected metrics with the same tags and different sources to share a series")
+	}
+
+	second.SecondaryData["region"] = "us"
+
+	if newSeriesKey(first, []string{"region"}) == newSeriesKey(second, []string{"region"}) {
+		t.Error("Expected identifying secondary data to split a series")
+	}
+
+	//without length prefixes these would both encode as requests,a,b
+	ambiguous := input.Metric{Name: "requests", Tags: map[string]string{"a,b": ""}}
+	other := input.Metric{Name: "requests", Tags: map[string]string{"a": "b"}}
+
+	if newSeriesKey(ambiguous, nil) == newSeriesKey(other, nil) {
+		t.Error("Expected distinct tags to produce distinct series")
+	}
+}
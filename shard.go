@@ -0,0 +1,243 @@
+package main
+
+import (
+	"time"
+
+	"github.com/ccpgames/aggregateD/input"
+	"github.com/ccpgames/aggregateD/output"
+)
+
+type (
+	//shard aggregates the metrics of a subset of series. Series are assigned
+	//to shards by the hash of their key, so a shard owns the buckets of its
+	//series outright and shards can aggregate in parallel without locking
+	shard struct {
+		metricsIn     chan keyedMetric
+		flushRequests chan flushRequest
+		metricBuckets map[seriesKey]map[int]timestampedBucket
+		//gauges holds the last known value of every gauge, it is not cleared
+		//when flushing so that deltas can be applied in the next flush
+		gauges map[seriesKey]*gaugeValue
+		//watermark is the end of the latest window which has been flushed,
+		//metrics for windows which end at or before it are late
+		watermark   int
+		lateSamples int64
+		lateMetrics []output.Bucket
+		aggregators map[string]func(seriesKey, input.Metric, *output.Bucket)
+		//summarisers calculate the fields of metric types which can only
+		//be calculated once every metric in a bucket has been received
+		summarisers map[string]func(*output.Bucket)
+	}
+
+	//keyedMetric is a metric along with the key of its series, the key is
+	//calculated once when choosing the shard
+	keyedMetric struct {
+		key    seriesKey
+		metric input.Metric
+	}
+
+	//flushRequest asks a shard for every window which ended at or before cutoff
+	flushRequest struct {
+		cutoff  int
+		flushed chan shardFlush
+	}
+
+	//shardFlush is the reply to a flushRequest, the windows have already been
+	//summarised and removed from the shard
+	shardFlush struct {
+		buckets     []output.Bucket
+		lateSamples int64
+	}
+
+	//gaugeValue is the last known value of a gauge, idleFlushes counts the
+	//flushes since it was last set so that unused gauges can be forgotten
+	gaugeValue struct {
+		value       float64
+		idleFlushes int
+	}
+
+	timestampedBucket struct {
+		StartTimestamp int
+		EndTimestamp   int
+		MetricBucket   *output.Bucket
+	}
+)
+
+func newShard() *shard {
+	s := new(shard)
+
+	s.aggregators = map[string]func(seriesKey, input.Metric, *output.Bucket){
+		"gauge":        s.gaugeAggregator,
+		"set":          s.setAggregator,
+		"counter":      s.counterAggregator,
+		"histogram":    s.histogramAggregator,
+		"timer":        s.timerAggregator,
+		"distribution": s.distributionAggregator,
+	}
+
+	s.summarisers = map[string]func(*output.Bucket){
+		"histogram":    s.histogramSummariser,
+		"set":          s.setSummariser,
+		"timer":        s.timerSummariser,
+		"distribution": s.distributionSummariser,
+	}
+
+	s.metricsIn = make(chan keyedMetric, 10000)
+	s.flushRequests = make(chan flushRequest)
+	s.metricBuckets = make(map[seriesKey]map[int]timestampedBucket)
+	s.gauges = make(map[seriesKey]*gaugeValue)
+
+	return s
+}
+
+//run aggregates metrics until the shard is asked to flush, flushing only
+//swaps out the closed windows so aggregation continues straight after
+func (s *shard) run() {
+	for {
+		select {
+		case received := <-s.metricsIn:
+			s.aggregateMetric(received.key, received.metric)
+		case request := <-s.flushRequests:
+			//metrics routed to the shard before the flush was requested are
+			//aggregated first, so that a final flush includes every metric
+			for pending := len(s.metricsIn); pending > 0; pending-- {
+				received := <-s.metricsIn
+				s.aggregateMetric(received.key, received.metric)
+			}
+			request.flushed <- s.flush(request.cutoff)
+		}
+	}
+}
+
+//aggregate metrics into a single bucket, makes use of aggregators
+//to aggregate different metric types
+func (s *shard) aggregateMetric(key seriesKey, receivedMetric input.Metric) {
+	//if a handler exists to aggregate the metric, do so
+	//otherwise ignore the metric
+	if handler, handlerOK := s.aggregators[receivedMetric.Type]; handlerOK {
+		//metrics without a timestamp, i.e. from statsD, are aggregated as
+		//having been received now
+		timestamp := int(parseTimestamp(receivedMetric.Timestamp).Unix())
+		start := windowStart(timestamp)
+
+		//the window this metric belongs to has already been written, adding
+		//it to a new window would overwrite the existing point with partial data
+		if start+configuration.AggregationInterval <= s.watermark {
+			s.lateMetric(receivedMetric)
+			return
+		}
+
+		_, outerBucketMapOK := s.metricBuckets[key]
+
+		//if this metric isn't know create a new map of windows for it
+		if !outerBucketMapOK {
+			s.metricBuckets[key] = make(map[int]timestampedBucket)
+		}
+
+		outerBucket, outerBucketOK := s.metricBuckets[key][start]
+
+		//if metric falls outside the time range we already have, make a new timestamped bucket
+		if !outerBucketOK {
+			innerBucket := new(output.Bucket)
+			outerBucket.StartTimestamp = start
+			outerBucket.EndTimestamp = start + configuration.AggregationInterval
+			innerBucket.Timestamp = time.Unix(int64(outerBucket.StartTimestamp), 0)
+			innerBucket.Name = receivedMetric.Name
+			innerBucket.Type = receivedMetric.Type
+			innerBucket.Interval = outerBucket.EndTimestamp - outerBucket.StartTimestamp
+			innerBucket.Fields = make(map[string]interface{})
+			innerBucket.Tags = receivedMetric.Tags
+
+			//metrics from the UDP inputs have no secondary data
+			for k, v := range receivedMetric.SecondaryData {
+				innerBucket.Fields[k] = v
+			}
+			outerBucket.MetricBucket = innerBucket
+			s.metricBuckets[key][start] = outerBucket
+		}
+
+		innerBucket := outerBucket.MetricBucket
+		handler(key, receivedMetric, innerBucket)
+
+	}
+}
+
+//lateMetric handles a metric which arrived after its window was written,
+//depending on the configuration it is either dropped or written on its own
+func (s *shard) lateMetric(receivedMetric input.Metric) {
+	s.lateSamples++
+
+	if configuration.LateSamples != "output" {
+		return
+	}
+
+	//late metrics are tagged so that they do not overwrite the aggregated point
+	lateBucket := new(output.Bucket)
+	lateBucket.Name = receivedMetric.Name
+	lateBucket.Timestamp = parseTimestamp(receivedMetric.Timestamp)
+	lateBucket.Fields = map[string]interface{}{"value": receivedMetric.Value}
+	lateBucket.Tags = map[string]string{"late": "true"}
+
+	for k, v := range receivedMetric.SecondaryData {
+		lateBucket.Fields[k] = v
+	}
+
+	for k, v := range receivedMetric.Tags {
+		lateBucket.Tags[k] = v
+	}
+
+	s.lateMetrics = append(s.lateMetrics, *lateBucket)
+}
+
+//flush removes and summarises every window which ended at or before cutoff,
+//open windows are kept until a later flush
+func (s *shard) flush(cutoff int) shardFlush {
+	var flushed shardFlush
+
+	for key, windows := range s.metricBuckets {
+		for start, window := range windows {
+			if window.EndTimestamp > cutoff {
+				continue
+			}
+
+			if summariser, ok := s.summarisers[window.MetricBucket.Type]; ok {
+				summariser(window.MetricBucket)
+			}
+			flushed.buckets = append(flushed.buckets, *window.MetricBucket)
+			delete(windows, start)
+
+			if window.EndTimestamp > s.watermark {
+				s.watermark = window.EndTimestamp
+			}
+		}
+
+		if len(windows) == 0 {
+			delete(s.metricBuckets, key)
+		}
+	}
+
+	s.expireGauges()
+
+	flushed.buckets = append(flushed.buckets, s.lateMetrics...)
+	flushed.lateSamples = s.lateSamples
+	s.lateMetrics = nil
+
+	return flushed
+}
+
+//expireGauges forgets the last value of gauges which have not been set for
+//the configured number of flushes, as etsy's statsD deleteGauges does, so
+//that gauges of series which are no longer reported do not use memory
+func (s *shard) expireGauges() {
+	if configuration.GaugeExpiryFlushes == 0 {
+		return
+	}
+
+	for key, gauge := range s.gauges {
+		gauge.idleFlushes++
+
+		if gauge.idleFlushes > configuration.GaugeExpiryFlushes {
+			delete(s.gauges, key)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+/*Package sketch provides bounded memory summaries of large streams of values.
+These allow aggregateD to summarise metrics which are sent many thousands of
+times per interval without storing every value.*/
+package sketch
+
+import (
+	"math"
+	"sort"
+)
+
+//minIndexableValue is the smallest magnitude which is given its own bin,
+//anything smaller is counted as zero
+const minIndexableValue = 1e-9
+
+/*DDSketch is a quantile sketch with a relative accuracy guarantee, as described
+in "DDSketch: A Fast and Fully-Mergeable Quantile Sketch with Relative-Error
+Guarantees". Values are counted in logarithmically sized bins, so any quantile
+is accurate to within relativeAccuracy of the true value while memory is bound
+by the number of bins rather than the number of values.
+
+If more than maxBins bins are needed the lowest bins are collapsed into one,
+which only affects the accuracy of the lowest quantiles.
+*/
+type DDSketch struct {
+	gamma     float64
+	logGamma  float64
+	maxBins   int
+	positive  store
+	negative  store
+	zeroCount float64
+	count     float64
+	sum       float64
+	min       float64
+	max       float64
+}
+
+//store holds the weight of each bin, floor is the lowest bin which may be
+//used once bins have been collapsed
+type store struct {
+	bins      map[int]float64
+	floor     int
+	collapsed bool
+}
+
+//NewDDSketch creates an empty sketch, relativeAccuracy must be between 0 and 1
+func NewDDSketch(relativeAccuracy float64, maxBins int) *DDSketch {
+	gamma := (1 + relativeAccuracy) / (1 - relativeAccuracy)
+
+	return &DDSketch{
+		gamma:    gamma,
+		logGamma: math.Log(gamma),
+		maxBins:  maxBins,
+		positive: store{bins: make(map[int]float64)},
+		negative: store{bins: make(map[int]float64)},
+		min:      math.Inf(1),
+		max:      math.Inf(-1),
+	}
+}
+
+//Add counts value weight times, sampled values have a weight greater than one
+func (s *DDSketch) Add(value float64, weight float64) {
+	if weight <= 0 || math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+
+	switch {
+	case value > minIndexableValue:
+		s.positive.add(s.index(value), weight, s.maxBins)
+	case value < -minIndexableValue:
+		s.negative.add(s.index(-value), weight, s.maxBins)
+	default:
+		s.zeroCount += weight
+	}
+
+	s.count += weight
+	s.sum += value * weight
+	s.min = math.Min(s.min, value)
+	s.max = math.Max(s.max, value)
+}
+
+//Quantile returns an estimate of the qth quantile, where q is between 0 and 1
+func (s *DDSketch) Quantile(q float64) float64 {
+	if s.count == 0 {
+		return 0
+	}
+
+	if q <= 0 {
+		return s.min
+	}
+
+	if q >= 1 {
+		return s.max
+	}
+
+	rank := q * (s.count - 1)
+	seen := 0.0
+
+	//negative values are stored by magnitude, so the largest bin is the
+	//smallest value
+	negativeKeys := s.negative.sortedKeys()
+	for i := len(negativeKeys) - 1; i >= 0; i-- {
+		seen += s.negative.bins[negativeKeys[i]]
+		if seen > rank {
+			return s.clamp(-s.value(negativeKeys[i]))
+		}
+	}
+
+	seen += s.zeroCount
+	if seen > rank {
+		return 0
+	}
+
+	positiveKeys := s.positive.sortedKeys()
+	for _, key := range positiveKeys {
+		seen += s.positive.bins[key]
+		if seen > rank {
+			return s.clamp(s.value(key))
+		}
+	}
+
+	return s.max
+}
+
+//Count returns the total weight of the values added to the sketch
+func (s *DDSketch) Count() float64 {
+	return s.count
+}
+
+//Sum returns the weighted sum of the values added to the sketch
+func (s *DDSketch) Sum() float64 {
+	return s.sum
+}
+
+//Min returns the smallest value added to the sketch
+func (s *DDSketch) Min() float64 {
+	return s.min
+}
+
+//Max returns the largest value added to the sketch
+func (s *DDSketch) Max() float64 {
+	return s.max
+}
+
+//index returns the bin of a positive value
+func (s *DDSketch) index(value float64) int {
+	return int(math.Ceil(math.Log(value) / s.logGamma))
+}
+
+//value returns the value which represents a bin, this is within the
+//relative accuracy of every value counted in the bin
+func (s *DDSketch) value(index int) float64 {
+	return 2 * math.Pow(s.gamma, float64(index)) / (s.gamma + 1)
+}
+
+//clamp ensures that estimates never fall outside of the values seen
+func (s *DDSketch) clamp(value float64) float64 {
+	return math.Max(s.min, math.Min(s.max, value))
+}
+
+func (st *store) add(index int, weight float64, maxBins int) {
+	if st.collapsed && index < st.floor {
+		index = st.floor
+	}
+
+	st.bins[index] += weight
+
+	if len(st.bins) > maxBins {
+		st.collapse(maxBins)
+	}
+}
+
+//collapse merges the lowest bins so that no more than maxBins remain, any
+//later values below the remaining lowest bin are counted in that bin
+func (st *store) collapse(maxBins int) {
+	keys := st.sortedKeys()
+	excess := len(keys) - maxBins
+	st.floor = keys[excess]
+
+	for _, key := range keys[:excess] {
+		st.bins[st.floor] += st.bins[key]
+		delete(st.bins, key)
+	}
+
+	st.collapsed = true
+}
+
+func (st *store) sortedKeys() []int {
+	keys := make([]int, 0, len(st.bins))
+
+	for key := range st.bins {
+		keys = append(keys, key)
+	}
+
+	sort.Ints(keys)
+	return keys
+}
@@ -0,0 +1,75 @@
+package sketch
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestDDSketchAccuracy(t *testing.T) {
+	accuracy := 0.01
+	s := NewDDSketch(accuracy, 2048)
+	values := make([]float64, 100000)
+
+	for i := range values {
+		values[i] = rand.ExpFloat64() * 250
+		s.Add(values[i], 1)
+	}
+
+	sort.Float64s(values)
+
+	for _, q := range []float64{0.5, 0.9, 0.95, 0.99, 0.999} {
+		expected := values[int(q*float64(len(values)-1))]
+		estimate := s.Quantile(q)
+
+		if math.Abs(estimate-expected) > accuracy*expected {
+			t.Errorf("quantile %v expected %v got %v", q, expected, estimate)
+		}
+	}
+
+	if s.Count() != float64(len(values)) {
+		t.Error("Expected count of", len(values), "got", s.Count())
+	}
+
+	if s.Min() != values[0] || s.Max() != values[len(values)-1] {
+		t.Error("Expected min and max to be exact got", s.Min(), s.Max())
+	}
+}
+
+func TestDDSketchNegativeValues(t *testing.T) {
+	s := NewDDSketch(0.01, 2048)
+
+	for i := -50; i <= 50; i++ {
+		s.Add(float64(i), 1)
+	}
+
+	if median := s.Quantile(0.5); median != 0 {
+		t.Error("Expected median of 0 got", median)
+	}
+
+	if q := s.Quantile(0.1); math.Abs(q+40) > 0.4 {
+		t.Error("Expected 10th percentile of -40 got", q)
+	}
+}
+
+func TestDDSketchBoundedBins(t *testing.T) {
+	s := NewDDSketch(0.01, 64)
+
+	for i := 1; i <= 100000; i++ {
+		s.Add(float64(i), 2)
+	}
+
+	if len(s.positive.bins) > 64 {
+		t.Error("Expected no more than 64 bins got", len(s.positive.bins))
+	}
+
+	if s.Count() != 200000 {
+		t.Error("Expected weighted count of 200000 got", s.Count())
+	}
+
+	//collapsing only affects the lowest values
+	if q := s.Quantile(0.99); math.Abs(q-99000) > 990 {
+		t.Error("Expected 99th percentile of 99000 got", q)
+	}
+}
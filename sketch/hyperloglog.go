@@ -0,0 +1,87 @@
+package sketch
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+/*HyperLogLog estimates the number of distinct values it has seen, as described
+in "HyperLogLog: the analysis of a near-optimal cardinality estimation
+algorithm". It uses 2^precision one byte registers, the standard error of the
+estimate is 1.04/sqrt(2^precision), i.e. 0.8% at the default precision of 14.
+*/
+type HyperLogLog struct {
+	precision uint
+	registers []uint8
+}
+
+//NewHyperLogLog creates an empty HyperLogLog, precision must be between 4 and 18
+func NewHyperLogLog(precision uint) *HyperLogLog {
+	return &HyperLogLog{
+		precision: precision,
+		registers: make([]uint8, 1<<precision),
+	}
+}
+
+//Add counts a value
+func (h *HyperLogLog) Add(value string) {
+	hash := hashString(value)
+
+	//the first precision bits select a register, the register keeps the
+	//longest run of leading zeros seen in the remaining bits
+	register := hash >> (64 - h.precision)
+	remaining := hash<<h.precision | 1<<(h.precision-1)
+	zeros := uint8(1)
+
+	for remaining&(1<<63) == 0 {
+		zeros++
+		remaining <<= 1
+	}
+
+	if zeros > h.registers[register] {
+		h.registers[register] = zeros
+	}
+}
+
+//Estimate returns the estimated number of distinct values which have been added
+func (h *HyperLogLog) Estimate() uint64 {
+	m := float64(len(h.registers))
+	sum := 0.0
+	emptyRegisters := 0
+
+	for _, register := range h.registers {
+		sum += math.Pow(2, -float64(register))
+
+		if register == 0 {
+			emptyRegisters++
+		}
+	}
+
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+
+	//the raw estimate is biased for small cardinalities, while there are
+	//empty registers linear counting is more accurate
+	if estimate <= 2.5*m && emptyRegisters > 0 {
+		estimate = m * math.Log(m/float64(emptyRegisters))
+	}
+
+	return uint64(estimate + 0.5)
+}
+
+//hashString hashes a value with FNV-1a, which is then mixed with the
+//murmur3 finaliser as the high bits of FNV are not well distributed for
+//short, similar strings such as sequential ids
+func hashString(value string) uint64 {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(value))
+	hash := hasher.Sum64()
+
+	hash ^= hash >> 33
+	hash *= 0xff51afd7ed558ccd
+	hash ^= hash >> 33
+	hash *= 0xc4ceb9fe1a85ec53
+	hash ^= hash >> 33
+
+	return hash
+}
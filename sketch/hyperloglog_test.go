@@ -0,0 +1,49 @@
+package sketch
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestHyperLogLogAccuracy(t *testing.T) {
+	for _, cardinality := range []int{100, 10000, 1000000} {
+		h := NewHyperLogLog(14)
+
+		//every member is added twice as duplicates must not be counted
+		for i := 0; i < cardinality; i++ {
+			h.Add("user" + strconv.Itoa(i))
+			h.Add("user" + strconv.Itoa(i))
+		}
+
+		estimate := float64(h.Estimate())
+		if math.Abs(estimate-float64(cardinality)) > 0.03*float64(cardinality) {
+			t.Errorf("Expected an estimate of %d got %v", cardinality, estimate)
+		}
+	}
+}
+
+func TestSetThreshold(t *testing.T) {
+	s := NewSet(100, 14)
+
+	for i := 0; i < 100; i++ {
+		s.Add(strconv.Itoa(i))
+		s.Add(strconv.Itoa(i))
+	}
+
+	if s.Count() != 100 || s.hll != nil {
+		t.Error("Expected an exact count of 100 got", s.Count())
+	}
+
+	for i := 100; i < 5000; i++ {
+		s.Add(strconv.Itoa(i))
+	}
+
+	if s.hll == nil || s.members != nil {
+		t.Error("Expected the set to be estimated once it passed its threshold")
+	}
+
+	if math.Abs(float64(s.Count())-5000) > 150 {
+		t.Error("Expected an estimate of 5000 got", s.Count())
+	}
+}
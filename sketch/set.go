@@ -0,0 +1,50 @@
+package sketch
+
+//Set counts the distinct members of a set. Members are counted exactly until
+//there are more than threshold of them, after which they are estimated using
+//a HyperLogLog so that memory use is bounded no matter how large the set is.
+type Set struct {
+	threshold int
+	precision uint
+	members   map[string]struct{}
+	hll       *HyperLogLog
+}
+
+//NewSet creates an empty set
+func NewSet(threshold int, precision uint) *Set {
+	return &Set{
+		threshold: threshold,
+		precision: precision,
+		members:   make(map[string]struct{}),
+	}
+}
+
+//Add adds a member to the set, adding a member more than once has no effect
+func (s *Set) Add(member string) {
+	if s.hll != nil {
+		s.hll.Add(member)
+		return
+	}
+
+	s.members[member] = struct{}{}
+
+	if len(s.members) > s.threshold {
+		s.hll = NewHyperLogLog(s.precision)
+
+		for existing := range s.members {
+			s.hll.Add(existing)
+		}
+
+		s.members = nil
+	}
+}
+
+//Count returns the number of distinct members in the set, this is exact
+//unless the set has grown beyond its threshold
+func (s *Set) Count() uint64 {
+	if s.hll != nil {
+		return s.hll.Estimate()
+	}
+
+	return uint64(len(s.members))
+}